@@ -0,0 +1,162 @@
+package button
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// SavedStateFile is the file in the data directory keeping the state last
+// set with 'platconf button', which platconf restores after an update
+const SavedStateFile = "button_state"
+
+// State is an LED pattern, the letter selects the pattern and the number its speed
+type State string
+
+// The patterns supported by the protobutton firmware
+const (
+	Busy     State = "b 1000"
+	Warning  State = "w 400"
+	Error    State = "e 400"
+	Noise    State = "n 1000"
+	Shimmer  State = "s 1000"
+	Rainbow  State = "r 1000"
+	Power    State = "p 700"
+	HDD      State = "h 700"
+	Startup  State = "u 700"
+	Shutdown State = "d 700"
+)
+
+// States maps the names of the patterns to their states
+var States = map[string]State{
+	"busy":     Busy,
+	"warning":  Warning,
+	"error":    Error,
+	"noise":    Noise,
+	"shimmer":  Shimmer,
+	"rainbow":  Rainbow,
+	"power":    Power,
+	"hdd":      HDD,
+	"startup":  Startup,
+	"shutdown": Shutdown,
+}
+
+// StateNames returns the names of all states in alphabetical order
+func StateNames() []string {
+	names := []string{}
+	for name := range States {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// ParseState returns the state with the given name
+func ParseState(name string) (State, error) {
+	state, ok := States[name]
+	if !ok {
+		return "", fmt.Errorf("unknown button state '%s', valid states are %v", name, StateNames())
+	}
+
+	return state, nil
+}
+
+// SaveState records the state, so it can be restored later on
+func SaveState(path string, state State) error {
+	return ioutil.WriteFile(path, []byte(string(state)+"\n"), 0644)
+}
+
+// LoadState returns the recorded state
+func LoadState(path string) (State, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return State(strings.TrimSpace(string(data))), nil
+}
+
+// Button shows a state on the LEDs of the hardware button
+type Button interface {
+	Set(state State) error
+}
+
+// The drivers which can be configured
+const (
+	DriverAuto        = "auto"
+	DriverProtobutton = "protobutton"
+	DriverNone        = "none"
+	DriverSimulated   = "simulated"
+)
+
+// New returns the button driver with the given name. The path is the device
+// of the protobutton driver and the file written by the simulated one. The
+// 'auto' driver uses the device if it exists and does nothing otherwise.
+func New(driver, path string) (Button, error) {
+	switch driver {
+	case DriverAuto:
+		_, err := os.Stat(path)
+		if err != nil {
+			return &Noop{}, nil
+		}
+		return &Protobutton{Path: path}, nil
+	case DriverProtobutton:
+		return &Protobutton{Path: path}, nil
+	case DriverNone:
+		return &Noop{}, nil
+	case DriverSimulated:
+		return &Simulated{Path: path}, nil
+	}
+
+	return nil, fmt.Errorf("unknown button driver '%s'", driver)
+}
+
+// Protobutton drives the button through the protobutton kernel module
+type Protobutton struct {
+	Path string
+}
+
+// Set writes the state to the device
+func (b *Protobutton) Set(state State) error {
+	buttonDev, err := os.OpenFile(b.Path, os.O_TRUNC|os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer buttonDev.Close()
+
+	_, err = buttonDev.WriteString(string(state) + "\n")
+	if err != nil {
+		return err
+	}
+
+	return buttonDev.Sync()
+}
+
+// Noop is used on machines without a button
+type Noop struct{}
+
+// Set does nothing
+func (b *Noop) Set(state State) error {
+	return nil
+}
+
+// Simulated appends every state as a line to a file, so the states can be
+// checked in tests. If the file is a FIFO, Set blocks until it's read.
+type Simulated struct {
+	Path string
+}
+
+// Set appends the state to the file
+func (b *Simulated) Set(state State) error {
+	f, err := os.OpenFile(b.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(string(state) + "\n")
+	return err
+}
@@ -0,0 +1,108 @@
+package button
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseState(t *testing.T) {
+	state, err := ParseState("rainbow")
+	assert.Nil(t, err)
+	assert.Equal(t, Rainbow, state)
+
+	_, err = ParseState("r 1000")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "busy")
+}
+
+func TestNew(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+	devicePath := path.Join(tempDir, "protobutton0")
+
+	b, err := New(DriverAuto, devicePath)
+	assert.Nil(t, err)
+	assert.IsType(t, &Noop{}, b)
+
+	assert.Nil(t, ioutil.WriteFile(devicePath, nil, 0644))
+	b, err = New(DriverAuto, devicePath)
+	assert.Nil(t, err)
+	assert.Equal(t, &Protobutton{Path: devicePath}, b)
+
+	b, err = New(DriverNone, devicePath)
+	assert.Nil(t, err)
+	assert.IsType(t, &Noop{}, b)
+
+	b, err = New(DriverSimulated, devicePath)
+	assert.Nil(t, err)
+	assert.Equal(t, &Simulated{Path: devicePath}, b)
+
+	_, err = New("foo", devicePath)
+	assert.NotNil(t, err)
+}
+
+func TestProtobutton(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+	devicePath := path.Join(tempDir, "protobutton0")
+
+	b := &Protobutton{Path: devicePath}
+	assert.NotNil(t, b.Set(Busy))
+
+	assert.Nil(t, ioutil.WriteFile(devicePath, nil, 0644))
+	assert.Nil(t, b.Set(Busy))
+	assert.Nil(t, b.Set(Error))
+
+	// the device only gets the current state
+	data, err := ioutil.ReadFile(devicePath)
+	assert.Nil(t, err)
+	assert.Equal(t, "e 400\n", string(data))
+}
+
+func TestSimulated(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	b := &Simulated{Path: path.Join(tempDir, "button")}
+	assert.Nil(t, b.Set(Rainbow))
+	assert.Nil(t, b.Set(Error))
+
+	data, err := ioutil.ReadFile(b.Path)
+	assert.Nil(t, err)
+	assert.Equal(t, "r 1000\ne 400\n", string(data))
+
+	fifoPath := path.Join(tempDir, "fifo")
+	assert.Nil(t, syscall.Mkfifo(fifoPath, 0644))
+	b = &Simulated{Path: fifoPath}
+
+	done := make(chan error)
+	go func() { done <- b.Set(Warning) }()
+
+	data, err = ioutil.ReadFile(fifoPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "w 400\n", string(data))
+	assert.Nil(t, <-done)
+}
+
+func TestSaveState(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+	statePath := path.Join(tempDir, SavedStateFile)
+
+	_, err = LoadState(statePath)
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Nil(t, SaveState(statePath, Shimmer))
+	state, err := LoadState(statePath)
+	assert.Nil(t, err)
+	assert.Equal(t, Shimmer, state)
+}
@@ -0,0 +1,56 @@
+package button
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/experimental-platform/platconf/platconf"
+)
+
+// Opts contains command line parameters for the 'button' command
+type Opts struct {
+	Args struct {
+		State string `positional-arg-name:"state" required:"true"`
+	} `positional-args:"true"`
+
+	Config *platconf.Config `no-flag:"true"`
+}
+
+// Execute is the function ran when the 'button' command is used
+func (o *Opts) Execute(args []string) error {
+	config := o.Config
+	if config == nil {
+		config = platconf.DefaultConfig()
+	}
+
+	state, err := ParseState(o.Args.State)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	platconf.RequireRoot()
+
+	b, err := New(config.ButtonDriver, config.ButtonDevice)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	err = b.Set(state)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set the button state: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	err = os.MkdirAll(config.DataDir, 0755)
+	if err == nil {
+		err = SaveState(path.Join(config.DataDir, SavedStateFile), state)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: failed to record the button state: %s\n", err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+)
+
+// SelfupdatePublicKey is the base64-encoded PKIX ECDSA public key used to verify
+// the signature of the release checksums. It is set at link time.
+var SelfupdatePublicKey string
+
+const (
+	checksumAssetName  = "SHA256SUMS"
+	signatureAssetName = "SHA256SUMS.sig"
+
+	// the checksum and signature files are tiny, anything bigger is bogus
+	maxChecksumAssetSize = 64 * 1024
+)
+
+// ErrNoPublicKey is returned when the signature can't be checked because the
+// binary was built without a public key
+var ErrNoPublicKey = errors.New("no public key has been embedded in this binary")
+
+// fetchSmallAsset downloads a checksum or signature file
+func fetchSmallAsset(url string) ([]byte, error) {
+	resp, err := selfupdateClient.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("fetchSmallAsset: Get: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetchSmallAsset: '%s' returned status code %d", url, resp.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(&limitedReader{R: resp.Body, N: maxChecksumAssetSize})
+	if err != nil {
+		return nil, fmt.Errorf("fetchSmallAsset: %s", err.Error())
+	}
+
+	return data, nil
+}
+
+// parseChecksums parses the output of sha256sum into a map of file names to hashes
+func parseChecksums(data []byte) (map[string]string, error) {
+	result := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 || len(fields[0]) != sha256.Size*2 {
+			return nil, fmt.Errorf("parseChecksums: malformed line '%s'", line)
+		}
+
+		// sha256sum marks files hashed in binary mode with an asterisk
+		result[strings.TrimPrefix(fields[1], "*")] = strings.ToLower(fields[0])
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// verifySignature checks the ASN.1-encoded ECDSA signature of data, as created
+// by 'openssl dgst -sha256 -sign key.pem', against the given public key
+func verifySignature(data, signature []byte, publicKey string) error {
+	if publicKey == "" {
+		return ErrNoPublicKey
+	}
+
+	der, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return fmt.Errorf("verifySignature: decoding the public key: %s", err.Error())
+	}
+
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return fmt.Errorf("verifySignature: parsing the public key: %s", err.Error())
+	}
+
+	ecdsaKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("verifySignature: the public key is not an ECDSA key")
+	}
+
+	var sig struct {
+		R, S *big.Int
+	}
+	rest, err := asn1.Unmarshal(signature, &sig)
+	if err != nil || len(rest) != 0 {
+		return fmt.Errorf("verifySignature: malformed signature")
+	}
+
+	hash := sha256.Sum256(data)
+	if !ecdsa.Verify(ecdsaKey, hash[:], sig.R, sig.S) {
+		return fmt.Errorf("verifySignature: signature mismatch")
+	}
+
+	return nil
+}
+
+// fetchVerifiedChecksums downloads the checksum file of a release and
+// verifies its signature. With 'insecure' a missing public key is tolerated.
+func fetchVerifiedChecksums(checksumURL, signatureURL string, insecure bool) (map[string]string, error) {
+	checksumData, err := fetchSmallAsset(checksumURL)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := fetchSmallAsset(signatureURL)
+	if err != nil {
+		return nil, err
+	}
+
+	err = verifySignature(checksumData, signature, SelfupdatePublicKey)
+	if err == ErrNoPublicKey && insecure {
+		fmt.Println("WARNING: no public key available, the release is NOT verified to be signed, only its checksum is checked.")
+	} else if err != nil {
+		return nil, err
+	}
+
+	return parseChecksums(checksumData)
+}
+
+// limitedReader works like io.LimitedReader, but fails instead of
+// silently truncating the data
+type limitedReader struct {
+	R io.Reader
+	N int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.R.Read(p)
+	l.N -= int64(n)
+	if l.N < 0 {
+		return n, fmt.Errorf("the data exceeds the maximum size")
+	}
+
+	return n, err
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeTestKey(t *testing.T) (*ecdsa.PrivateKey, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.Nil(t, err)
+
+	return key, base64.StdEncoding.EncodeToString(der)
+}
+
+func signTestData(t *testing.T, key *ecdsa.PrivateKey, data []byte) []byte {
+	hash := sha256.Sum256(data)
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	assert.Nil(t, err)
+
+	signature, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	assert.Nil(t, err)
+
+	return signature
+}
+
+func TestParseChecksums(t *testing.T) {
+	data := []byte(`e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855  platconf-v1
+E3B0C44298FC1C149AFBF4C8996FB92427AE41E4649B934CA495991B7852B855 *platconf-v2
+
+`)
+	checksums, err := parseChecksums(data)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"platconf-v1": "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		"platconf-v2": "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+	}, checksums)
+
+	_, err = parseChecksums([]byte("deadbeef  platconf"))
+	assert.NotNil(t, err)
+}
+
+func TestVerifySignature(t *testing.T) {
+	key, publicKey := makeTestKey(t)
+	_, otherPublicKey := makeTestKey(t)
+	data := []byte("some checksums")
+	signature := signTestData(t, key, data)
+
+	assert.Nil(t, verifySignature(data, signature, publicKey))
+	assert.NotNil(t, verifySignature([]byte("other checksums"), signature, publicKey))
+	assert.NotNil(t, verifySignature(data, signature, otherPublicKey))
+	assert.NotNil(t, verifySignature(data, []byte("garbage"), publicKey))
+	assert.Equal(t, ErrNoPublicKey, verifySignature(data, signature, ""))
+}
+
+func TestFetchVerifiedChecksums(t *testing.T) {
+	key, publicKey := makeTestKey(t)
+	checksumData := []byte("e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855  platconf\n")
+	signature := signTestData(t, key, checksumData)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/SHA256SUMS", func(w http.ResponseWriter, r *http.Request) { w.Write(checksumData) })
+	mux.HandleFunc("/SHA256SUMS.sig", func(w http.ResponseWriter, r *http.Request) { w.Write(signature) })
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	defer func(k string) { SelfupdatePublicKey = k }(SelfupdatePublicKey)
+
+	SelfupdatePublicKey = publicKey
+	checksums, err := fetchVerifiedChecksums(srv.URL+"/SHA256SUMS", srv.URL+"/SHA256SUMS.sig", false)
+	assert.Nil(t, err)
+	assert.Equal(t, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", checksums["platconf"])
+
+	// missing signature
+	_, err = fetchVerifiedChecksums(srv.URL+"/SHA256SUMS", srv.URL+"/nothing", false)
+	assert.NotNil(t, err)
+
+	// no key embedded
+	SelfupdatePublicKey = ""
+	_, err = fetchVerifiedChecksums(srv.URL+"/SHA256SUMS", srv.URL+"/SHA256SUMS.sig", false)
+	assert.Equal(t, ErrNoPublicKey, err)
+	_, err = fetchVerifiedChecksums(srv.URL+"/SHA256SUMS", srv.URL+"/SHA256SUMS.sig", true)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/experimental-platform/platconf/platconf"
+)
+
+type configOpts struct {
+	Show configShowOpts `command:"show" description:"Print the effective configuration and where each value comes from"`
+}
+
+type configShowOpts struct {
+}
+
+func (o *configShowOpts) Execute(args []string) error {
+	fmt.Printf("Config file: %s\n", platconf.ConfigPath())
+	for _, f := range opts.Config.Fields() {
+		fmt.Printf("%s: '%s' (%s)\n", f.Name, *f.Value, opts.Config.Source(f.Name))
+	}
+
+	return nil
+}
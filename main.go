@@ -5,6 +5,7 @@ import (
 	"os"
 	"os/user"
 
+	"github.com/experimental-platform/platconf/platconf"
 	"github.com/jessevdk/go-flags"
 )
 
@@ -22,8 +23,30 @@ func requireRoot() {
 }
 
 func main() {
+	config, err := platconf.LoadConfig(platconf.ConfigPath())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load the configuration: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	// the flags parsed below override the loaded values
+	opts.Config = *config
+	opts.Update.Config = &opts.Config
+	opts.OldStatus.Config = &opts.Config
+	opts.Channel.List.Config = &opts.Config
+	opts.Channel.Show.Config = &opts.Config
+	opts.Channel.Set.Config = &opts.Config
+	opts.Status.Config = &opts.Config
+	opts.Status.PlatconfVersion = VersionTag
+	opts.Verify.Config = &opts.Config
+	opts.Bundle.Create.Config = &opts.Config
+	opts.Doctor.Config = &opts.Config
+	opts.Postboot.Config = &opts.Config
+	opts.Unlock.Config = &opts.Config
+	opts.Button.Config = &opts.Config
+
 	parser := flags.NewParser(&opts, flags.Default)
-	_, err := parser.Parse()
+	_, err = parser.Parse()
 	if err != nil {
 		if flagserr, ok := err.(*flags.Error); !ok || flagserr.Type != flags.ErrHelp {
 			parser.WriteHelp(os.Stdout)
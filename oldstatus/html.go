@@ -31,8 +31,13 @@ if (statusObject == null) {
 	var status = statusObject['status'];
 	var progress = statusObject['progress'];
 	var what = statusObject['what'];
+	var updateStartedAt = statusObject['update_started_at'];
+	var updatePhase = statusObject['update_phase'];
 
 	document.getElementById("status_text").innerHTML += status + "<br />";
+	if (updateStartedAt != null) {
+		document.getElementById("status_text").innerHTML += "Update in progress since " + new Date(updateStartedAt).toLocaleString() + " (" + updatePhase + ")<br />";
+	}
 	if (progress != null) {
 		document.getElementById("status_text").innerHTML += "Download progress: " + progress.toFixed(1) + "%<br />";
 	}
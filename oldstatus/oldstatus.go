@@ -8,15 +8,22 @@ import (
 	"net/http"
 	"os"
 	"sync"
+	"time"
 
+	"github.com/experimental-platform/platconf/platconf"
 	"github.com/fsnotify/fsnotify"
 )
 
 // Opts contains command line parameters for the 'oldstatus' command
 type Opts struct {
-	Port         int    `short:"p" long:"port" description:"Port on which to listen" default:"7887"`
-	StatusFile   string `long:"status-file" description:"Path to old platform-configure status file" default:"/etc/protonet/system/configure-script-status"`
-	StatusSocket string `long:"status-socket" description:"Path to status socket" default:"/var/run/platconf-status.sock"`
+	Port int `short:"p" long:"port" description:"Port on which to listen" default:"7887"`
+
+	// StatusFile, StatusSocket and LockFile are taken from Config if it is set, where
+	// they are available as the global '--status-file', '--status-socket' and '--lock-file'
+	StatusFile   string           `no-flag:"true"`
+	StatusSocket string           `no-flag:"true"`
+	LockFile     string           `no-flag:"true"`
+	Config       *platconf.Config `no-flag:"true"`
 }
 
 // StatusData is the data structure sent to the status page
@@ -25,6 +32,33 @@ type StatusData struct {
 	Progress     *float32 `json:"progress"`
 	What         *string  `json:"what"`
 	sync.RWMutex `json:"-"`
+
+	// taken from the update lock while an update is running
+	UpdateStartedAt *time.Time `json:"update_started_at"`
+	UpdatePhase     *string    `json:"update_phase"`
+	lockFile        string
+}
+
+// updateLockStatus fills in the start and phase of the running update,
+// the caller has to hold the write lock
+func updateLockStatus(status *StatusData) {
+	status.UpdateStartedAt = nil
+	status.UpdatePhase = nil
+
+	info, err := platconf.ReadLockInfo(status.lockFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("ERROR: failed to read the update lock information:", err.Error())
+		}
+		return
+	}
+
+	if info.IsStale() {
+		return
+	}
+
+	status.UpdateStartedAt = &info.StartedAt
+	status.UpdatePhase = &info.Phase
 }
 
 func updateStatusFromFile(status *StatusData, filePath string) error {
@@ -123,8 +157,11 @@ func listenOnUnixSocket(status *StatusData, path string) error {
 func getStatusReadMux(status *StatusData) *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/json", func(w http.ResponseWriter, r *http.Request) {
-		status.RLock()
-		defer status.RUnlock()
+		status.Lock()
+		defer status.Unlock()
+		if status.lockFile != "" {
+			updateLockStatus(status)
+		}
 		w.Header().Set("Content-Type", "application/json")
 		encoder := json.NewEncoder(w)
 		encoder.Encode(&status)
@@ -147,6 +184,13 @@ func getStatusReadMux(status *StatusData) *http.ServeMux {
 func (o *Opts) Execute(args []string) error {
 	var status StatusData
 
+	if o.Config != nil {
+		o.StatusFile = o.Config.StatusFile
+		o.StatusSocket = o.Config.StatusSocket
+		o.LockFile = o.Config.LockFile
+	}
+	status.lockFile = o.LockFile
+
 	err := updateStatusFromFile(&status, o.StatusFile)
 	if err != nil {
 		log.Printf("ERROR: failed to read status from SKVS file: %s", err.Error())
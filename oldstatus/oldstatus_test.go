@@ -15,6 +15,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/experimental-platform/platconf/platconf"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -72,6 +73,47 @@ func TestGetStatus(t *testing.T) {
 	status.RUnlock()
 }
 
+func TestGetStatusUpdateLock(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	status := StatusData{lockFile: path.Join(tempDir, "platconf.lock")}
+	srv := httptest.NewServer(getStatusReadMux(&status))
+
+	u, err := url.Parse(srv.URL)
+	assert.Nil(t, err)
+	u.Path = path.Join(u.Path, "json")
+
+	getStatus := func() *StatusData {
+		var responseStatus StatusData
+		resp, err := http.Get(u.String())
+		assert.Nil(t, err)
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&responseStatus))
+		resp.Body.Close()
+		return &responseStatus
+	}
+
+	// no update running
+	responseStatus := getStatus()
+	assert.Nil(t, responseStatus.UpdateStartedAt)
+	assert.Nil(t, responseStatus.UpdatePhase)
+
+	startedAt := time.Unix(1500000000, 0).UTC()
+	err = platconf.WriteLockInfo(status.lockFile, &platconf.LockInfo{PID: os.Getpid(), StartedAt: startedAt, Phase: "downloading"})
+	assert.Nil(t, err)
+	responseStatus = getStatus()
+	assert.Equal(t, startedAt, responseStatus.UpdateStartedAt.UTC())
+	assert.Equal(t, "downloading", *responseStatus.UpdatePhase)
+
+	// the holder is gone
+	err = platconf.WriteLockInfo(status.lockFile, &platconf.LockInfo{StartedAt: startedAt, Phase: "downloading"})
+	assert.Nil(t, err)
+	responseStatus = getStatus()
+	assert.Nil(t, responseStatus.UpdateStartedAt)
+	assert.Nil(t, responseStatus.UpdatePhase)
+}
+
 func TestGetFavicon(t *testing.T) {
 	// prepare
 	mux := getStatusReadMux(nil)
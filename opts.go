@@ -1,13 +1,25 @@
 package main
 
 import (
+	"github.com/experimental-platform/platconf/button"
 	"github.com/experimental-platform/platconf/oldstatus"
+	"github.com/experimental-platform/platconf/platconf"
 	"github.com/experimental-platform/platconf/update"
 )
 
 var opts struct {
-	Update     update.Opts    `command:"update"`
-	SelfUpdate selfupdateOpts `command:"selfupdate"`
-	Version    versionOpts    `command:"version"`
-	OldStatus  oldstatus.Opts `command:"oldstatus"`
+	Config     platconf.Config     `group:"Configuration Options"`
+	Update     update.Opts         `command:"update"`
+	SelfUpdate selfupdateOpts      `command:"selfupdate"`
+	Version    versionOpts         `command:"version"`
+	OldStatus  oldstatus.Opts      `command:"oldstatus"`
+	ConfigCmd  configOpts          `command:"config"`
+	Channel    update.ChannelOpts  `command:"channel"`
+	Status     update.StatusOpts   `command:"status"`
+	Verify     update.VerifyOpts   `command:"verify"`
+	Bundle     update.BundleOpts   `command:"bundle"`
+	Doctor     update.DoctorOpts   `command:"doctor"`
+	Postboot   update.PostbootOpts `command:"postboot"`
+	Unlock     update.UnlockOpts   `command:"unlock"`
+	Button     button.Opts         `command:"button"`
 }
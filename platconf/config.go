@@ -0,0 +1,178 @@
+package platconf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultConfigPath is where the configuration file is looked up
+// unless $PLATCONF_CONFIG points somewhere else
+const DefaultConfigPath = "/etc/protonet/platconf.yaml"
+
+// ConfigSource describes where a configuration value has been taken from
+type ConfigSource int
+
+// The sources are listed in the order of increasing priority
+const (
+	CfgDefault     ConfigSource = iota
+	CfgFile        ConfigSource = iota
+	CfgEnvironment ConfigSource = iota
+	CfgCommandLine ConfigSource = iota
+)
+
+func (cs ConfigSource) String() string {
+	switch cs {
+	case CfgFile:
+		return "config file"
+	case CfgEnvironment:
+		return "environment"
+	case CfgCommandLine:
+		return "command line"
+	default:
+		return "default"
+	}
+}
+
+// Config contains the settings shared by all commands. The values are
+// taken from the built-in defaults, the config file, the environment and the
+// command line, each one overriding the previous.
+type Config struct {
+	LockFile         string `long:"lock-file" yaml:"lock_file" description:"Path to the update lock file"`
+	ChannelFile      string `long:"channel-file" yaml:"channel_file" description:"Path to the file containing the channel"`
+	DefaultChannel   string `long:"default-channel" yaml:"default_channel" description:"Channel used if none has been set"`
+	StatusSocket     string `long:"status-socket" yaml:"status_socket" description:"Path to status socket"`
+	StatusFile       string `long:"status-file" yaml:"status_file" description:"Path to old platform-configure status file"`
+	DockerConfig     string `long:"docker-config" yaml:"docker_config" description:"Path to the Docker client config with registry credentials"`
+	ManifestURL      string `long:"manifest-url" yaml:"manifest_url" description:"URL of the v2 release manifest, '%s' is replaced with the channel"`
+	ManifestURLv1    string `long:"manifest-url-v1" yaml:"manifest_url_v1" description:"URL of the v1 release manifest, '%s' is replaced with the channel"`
+	ChannelListURL   string `long:"channel-list-url" yaml:"channel_list_url" description:"GitHub API URL of the directory containing the v2 manifests"`
+	SelfupdateTarget string `long:"selfupdate-target" yaml:"selfupdate_target" description:"Path the platconf binary is installed to by selfupdate"`
+	SelfupdateSource string `long:"selfupdate-source" yaml:"selfupdate_source" description:"GitHub API URL, HTTP URL or local path of the platconf release list"`
+	ExtractMethod    string `long:"extract-method" yaml:"extract_method" description:"How images are extracted, 'export' (from a temporary container) or 'save' (from the image layers)"`
+	RegistryMirror   string `long:"registry-mirror" yaml:"registry_mirror" description:"Registry host replacing 'quay.io' in image names, e.g. 'mirror.local:5000', prefix it with 'http://' if the mirror doesn't support HTTPS"`
+	DataDir          string `long:"data-dir" yaml:"data_dir" description:"Directory where platconf keeps archived releases and other state"`
+	ButtonDriver     string `long:"button-driver" yaml:"button_driver" description:"How the button LEDs are driven, 'auto', 'protobutton', 'none' or 'simulated'"`
+	ButtonDevice     string `long:"button-device" yaml:"button_device" description:"Path of the button device, or of the file written by the simulated driver"`
+	ButtonPhases     string `long:"button-phases" yaml:"button_phases" description:"Button states shown during the update phases and, as 'idle', afterwards, e.g. 'downloading=noise,finalizing=none,idle=power'"`
+
+	sources map[string]ConfigSource
+	loaded  map[string]string
+}
+
+// ConfigField describes a single configuration value
+type ConfigField struct {
+	Name  string // key in the config file
+	Env   string // name of the environment variable
+	Value *string
+}
+
+// Fields returns all configuration values in a fixed order
+func (c *Config) Fields() []ConfigField {
+	return []ConfigField{
+		{"lock_file", "PLATCONF_LOCK_FILE", &c.LockFile},
+		{"channel_file", "PLATCONF_CHANNEL_FILE", &c.ChannelFile},
+		{"default_channel", "PLATCONF_DEFAULT_CHANNEL", &c.DefaultChannel},
+		{"status_socket", "PLATCONF_STATUS_SOCKET", &c.StatusSocket},
+		{"status_file", "PLATCONF_STATUS_FILE", &c.StatusFile},
+		{"docker_config", "PLATCONF_DOCKER_CONFIG", &c.DockerConfig},
+		{"manifest_url", "PLATCONF_MANIFEST_URL", &c.ManifestURL},
+		{"manifest_url_v1", "PLATCONF_MANIFEST_URL_V1", &c.ManifestURLv1},
+		{"channel_list_url", "PLATCONF_CHANNEL_LIST_URL", &c.ChannelListURL},
+		{"selfupdate_target", "PLATCONF_SELFUPDATE_TARGET", &c.SelfupdateTarget},
+		{"selfupdate_source", "PLATCONF_SELFUPDATE_SOURCE", &c.SelfupdateSource},
+		{"extract_method", "PLATCONF_EXTRACT_METHOD", &c.ExtractMethod},
+		{"registry_mirror", "PLATCONF_REGISTRY_MIRROR", &c.RegistryMirror},
+		{"data_dir", "PLATCONF_DATA_DIR", &c.DataDir},
+		{"button_driver", "PLATCONF_BUTTON_DRIVER", &c.ButtonDriver},
+		{"button_device", "PLATCONF_BUTTON_DEVICE", &c.ButtonDevice},
+		{"button_phases", "PLATCONF_BUTTON_PHASES", &c.ButtonPhases},
+	}
+}
+
+// DefaultConfig returns the built-in configuration
+func DefaultConfig() *Config {
+	return &Config{
+		LockFile:         "/var/run/platconf.lock",
+		ChannelFile:      "/etc/protonet/system/channel",
+		DefaultChannel:   "soul3",
+		StatusSocket:     "/var/run/platconf-status.sock",
+		StatusFile:       "/etc/protonet/system/configure-script-status",
+		DockerConfig:     "/root/.docker/config.json",
+		ManifestURL:      "https://raw.githubusercontent.com/protonet/builds/master/manifest-v2/%s.json",
+		ManifestURLv1:    "https://raw.githubusercontent.com/protonet/builds/master/%s.json",
+		ChannelListURL:   "https://api.github.com/repos/protonet/builds/contents/manifest-v2",
+		SelfupdateTarget: "/opt/bin/platconf",
+		SelfupdateSource: "https://api.github.com/repos/experimental-platform/platconf/releases",
+		ExtractMethod:    "export",
+		DataDir:          "/var/lib/platconf",
+		ButtonDriver:     "auto",
+		ButtonDevice:     "/dev/protobutton0",
+	}
+}
+
+// ConfigPath returns the path of the config file to be used
+func ConfigPath() string {
+	if p := os.Getenv("PLATCONF_CONFIG"); p != "" {
+		return p
+	}
+
+	return DefaultConfigPath
+}
+
+// LoadConfig reads the config file from the given path, if it exists,
+// and applies the environment variables on top of it.
+func LoadConfig(path string) (*Config, error) {
+	c := DefaultConfig()
+	c.sources = make(map[string]ConfigSource)
+	c.loaded = make(map[string]string)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err == nil {
+		fileConfig := make(map[string]string)
+		err = yaml.Unmarshal(data, &fileConfig)
+		if err != nil {
+			return nil, fmt.Errorf("LoadConfig: parsing '%s': %s", path, err.Error())
+		}
+
+		for _, f := range c.Fields() {
+			if value, ok := fileConfig[f.Name]; ok && value != "" {
+				*f.Value = value
+				c.sources[f.Name] = CfgFile
+			}
+		}
+	}
+
+	for _, f := range c.Fields() {
+		if value := os.Getenv(f.Env); value != "" {
+			*f.Value = value
+			c.sources[f.Name] = CfgEnvironment
+		}
+		c.loaded[f.Name] = *f.Value
+	}
+
+	return c, nil
+}
+
+// Source returns where the value of the given field came from.
+// Values that have changed since LoadConfig were set on the command line.
+func (c *Config) Source(name string) ConfigSource {
+	for _, f := range c.Fields() {
+		if f.Name != name {
+			continue
+		}
+
+		if loaded, ok := c.loaded[f.Name]; ok && loaded != *f.Value {
+			return CfgCommandLine
+		}
+		break
+	}
+
+	return c.sources[name]
+}
@@ -0,0 +1,57 @@
+package platconf
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfigNoFile(t *testing.T) {
+	config, err := LoadConfig("/this/file/should/not/exist.yaml")
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultConfig().LockFile, config.LockFile)
+	assert.Equal(t, "soul3", config.DefaultChannel)
+	assert.Equal(t, CfgDefault, config.Source("lock_file"))
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	configPath := path.Join(tempDir, "platconf.yaml")
+	err = ioutil.WriteFile(configPath, []byte("default_channel: foobar\nlock_file: /tmp/file.lock\n"), 0644)
+	assert.Nil(t, err)
+
+	os.Setenv("PLATCONF_LOCK_FILE", "/tmp/env.lock")
+	defer os.Unsetenv("PLATCONF_LOCK_FILE")
+
+	config, err := LoadConfig(configPath)
+	assert.Nil(t, err)
+
+	assert.Equal(t, "foobar", config.DefaultChannel)
+	assert.Equal(t, CfgFile, config.Source("default_channel"))
+	assert.Equal(t, "/tmp/env.lock", config.LockFile)
+	assert.Equal(t, CfgEnvironment, config.Source("lock_file"))
+	assert.Equal(t, DefaultConfig().ChannelFile, config.ChannelFile)
+	assert.Equal(t, CfgDefault, config.Source("channel_file"))
+
+	// this is what the flag parser does
+	config.ChannelFile = "/tmp/channel"
+	assert.Equal(t, CfgCommandLine, config.Source("channel_file"))
+}
+
+func TestLoadConfigBroken(t *testing.T) {
+	tempFile, err := ioutil.TempFile("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.Remove(tempFile.Name())
+
+	tempFile.WriteString("lock_file: [what")
+	tempFile.Close()
+
+	_, err = LoadConfig(tempFile.Name())
+	assert.NotNil(t, err)
+}
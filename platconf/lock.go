@@ -0,0 +1,118 @@
+package platconf
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// BootIDPath is the file containing the ID of the current boot
+var BootIDPath = "/proc/sys/kernel/random/boot_id"
+
+// LockInfo describes the process holding the update lock. It's stored next
+// to the lock file, which only contains the PID.
+type LockInfo struct {
+	PID       int       `json:"pid"`
+	StartedAt time.Time `json:"started_at"`
+	Phase     string    `json:"phase"`
+	BootID    string    `json:"boot_id"`
+	Command   string    `json:"command"`
+}
+
+// LockInfoPath returns the path of the information about the given lock
+func LockInfoPath(lockPath string) string {
+	return lockPath + ".info"
+}
+
+// BootID returns the ID of the current boot, or an empty string if it's unknown
+func BootID() string {
+	data, err := ioutil.ReadFile(BootIDPath)
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(data))
+}
+
+// ReadLockInfo reads the information about the given lock
+func ReadLockInfo(lockPath string) (*LockInfo, error) {
+	data, err := ioutil.ReadFile(LockInfoPath(lockPath))
+	if err != nil {
+		return nil, err
+	}
+
+	var info LockInfo
+	err = json.Unmarshal(data, &info)
+	if err != nil {
+		return nil, fmt.Errorf("ReadLockInfo: %s", err.Error())
+	}
+
+	return &info, nil
+}
+
+// WriteLockInfo atomically replaces the information about the given lock
+func WriteLockInfo(lockPath string, info *LockInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	infoPath := LockInfoPath(lockPath)
+	tempFile, err := ioutil.TempFile(path.Dir(infoPath), path.Base(infoPath))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+
+	_, err = tempFile.Write(data)
+	tempFile.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(tempFile.Name(), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tempFile.Name(), infoPath)
+}
+
+// FromOtherBoot tells whether the lock has been taken before the last reboot
+func (li *LockInfo) FromOtherBoot() bool {
+	current := BootID()
+	return li.BootID != "" && current != "" && li.BootID != current
+}
+
+// IsStale tells whether the process holding the lock is gone
+func (li *LockInfo) IsStale() bool {
+	if li.FromOtherBoot() {
+		return true
+	}
+
+	if li.PID <= 0 {
+		return true
+	}
+
+	process, err := os.FindProcess(li.PID)
+	if err != nil {
+		return true
+	}
+
+	err = process.Signal(syscall.Signal(0))
+	if err == nil {
+		return false
+	}
+
+	// EPERM means the process exists but belongs to someone else
+	if sysErr, ok := err.(*os.SyscallError); ok && sysErr.Err == syscall.EPERM {
+		return false
+	}
+
+	return true
+}
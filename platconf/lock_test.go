@@ -0,0 +1,65 @@
+package platconf
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockInfo(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+	lockPath := path.Join(tempDir, "platconf.lock")
+
+	_, err = ReadLockInfo(lockPath)
+	assert.True(t, os.IsNotExist(err))
+
+	info := &LockInfo{PID: 1234, StartedAt: time.Unix(1500000000, 0).UTC(), Phase: "downloading", BootID: "foo", Command: "update"}
+	assert.Nil(t, WriteLockInfo(lockPath, info))
+
+	readInfo, err := ReadLockInfo(lockPath)
+	assert.Nil(t, err)
+	assert.Equal(t, info, readInfo)
+
+	// no temporary files are left behind
+	files, err := ioutil.ReadDir(tempDir)
+	assert.Nil(t, err)
+	assert.Len(t, files, 1)
+}
+
+func TestLockInfoIsStale(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	defer func(p string) { BootIDPath = p }(BootIDPath)
+	BootIDPath = path.Join(tempDir, "boot_id")
+	assert.Nil(t, ioutil.WriteFile(BootIDPath, []byte("current\n"), 0644))
+	assert.Equal(t, "current", BootID())
+
+	info := LockInfo{PID: os.Getpid(), BootID: "current"}
+	assert.False(t, info.FromOtherBoot())
+	assert.False(t, info.IsStale())
+
+	info.BootID = "previous"
+	assert.True(t, info.FromOtherBoot())
+	assert.True(t, info.IsStale())
+
+	// the boot can't be told without a boot ID
+	info.BootID = ""
+	assert.False(t, info.FromOtherBoot())
+
+	cmd := exec.Command("true")
+	assert.Nil(t, cmd.Run())
+	info.PID = cmd.Process.Pid
+	assert.True(t, info.IsStale())
+
+	info.PID = 0
+	assert.True(t, info.IsStale())
+}
@@ -1,5 +1,9 @@
 package platconf
 
+// SupportedManifestVersions lists the manifest schema versions this
+// version of platconf can install
+var SupportedManifestVersions = []int{1, 2}
+
 // ReleaseManifestV1 describes a the build manifests used
 // by Kamil's update system in late 2016.
 type ReleaseManifestV1 struct {
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxRateLimitWait is the longest we wait for the GitHub API rate limit to reset
+const maxRateLimitWait = 60 * time.Second
+
+// selfupdateTimeout limits every selfupdate request including reading its
+// body, so it has to leave room for downloading the binary
+const selfupdateTimeout = 5 * time.Minute
+
+// sourceTransport serves 'file://' URLs from the local filesystem and passes
+// everything else on to the default transport
+type sourceTransport struct{}
+
+func (sourceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "file" {
+		return http.NewFileTransport(http.Dir("/")).RoundTrip(req)
+	}
+
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// selfupdateClient is used for all selfupdate downloads, so releases
+// can be installed from a local directory as well
+var selfupdateClient = &http.Client{Transport: sourceTransport{}, Timeout: selfupdateTimeout}
+
+// sourceURL turns the configured release source into a URL, local paths
+// become 'file://' URLs
+func sourceURL(source string) (*url.URL, error) {
+	if strings.HasPrefix(source, "/") || strings.HasPrefix(source, ".") {
+		absPath, err := filepath.Abs(source)
+		if err != nil {
+			return nil, err
+		}
+		return &url.URL{Scheme: "file", Path: absPath}, nil
+	}
+
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "https", "file":
+		return u, nil
+	default:
+		return nil, fmt.Errorf("unsupported release source '%s'", source)
+	}
+}
+
+// rateLimitReset returns when the GitHub API rate limit resets, if the
+// response says that it has been exceeded
+func rateLimitReset(resp *http.Response) (time.Time, bool) {
+	if resp.StatusCode == http.StatusTooManyRequests {
+		seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+		if err != nil {
+			seconds = 60
+		}
+		return time.Now().Add(time.Duration(seconds) * time.Second), true
+	}
+
+	if resp.StatusCode == http.StatusForbidden && resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+		if err != nil {
+			return time.Now().Add(time.Hour), true
+		}
+		return time.Unix(reset, 0), true
+	}
+
+	return time.Time{}, false
+}
+
+// getReleaseList downloads the release list, waiting once for the rate
+// limit to reset if that is going to happen soon
+func getReleaseList(listURL string) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest("GET", listURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/vnd.github.v3+json")
+
+		resp, err := selfupdateClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		reset, limited := rateLimitReset(resp)
+		if !limited {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		wait := reset.Sub(time.Now())
+		if attempt > 0 || wait > maxRateLimitWait {
+			return nil, fmt.Errorf("the API rate limit of '%s' has been exceeded, try again after %s", listURL, reset.Format(time.RFC1123))
+		}
+
+		if wait > 0 {
+			fmt.Printf("API rate limit exceeded, waiting %s for it to reset\n", wait/time.Second*time.Second)
+			time.Sleep(wait)
+		}
+	}
+}
+
+// fetchReleases downloads the list of releases from the given source. This
+// can be the releases endpoint of the GitHub API (including GitHub
+// Enterprise), or a JSON file in the same format served over HTTP or stored
+// locally. Relative asset URLs are resolved against the list's URL.
+func fetchReleases(source string) ([]githubRelease, error) {
+	base, err := sourceURL(source)
+	if err != nil {
+		return nil, fmt.Errorf("fetchReleases: %s", err.Error())
+	}
+
+	listURL := *base
+	if strings.HasSuffix(listURL.Path, "/releases") && listURL.RawQuery == "" {
+		// the GitHub API pages the list, fetch as much as it allows
+		listURL.RawQuery = "per_page=100"
+	}
+
+	resp, err := getReleaseList(listURL.String())
+	if err != nil {
+		return nil, fmt.Errorf("fetchReleases: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetchReleases: '%s' returned status code %d", listURL.String(), resp.StatusCode)
+	}
+
+	var releases []githubRelease
+	err = json.NewDecoder(resp.Body).Decode(&releases)
+	if err != nil {
+		return nil, fmt.Errorf("fetchReleases: parsing the release list: %s", err.Error())
+	}
+
+	for i := range releases {
+		for j := range releases[i].Assets {
+			asset := &releases[i].Assets[j]
+			ref, err := url.Parse(asset.BrowserDownloadURL)
+			if err != nil {
+				return nil, fmt.Errorf("fetchReleases: asset '%s' of release %s: %s", asset.Name, releases[i].TagName, err.Error())
+			}
+			asset.BrowserDownloadURL = base.ResolveReference(ref).String()
+		}
+	}
+
+	return releases, nil
+}
+
+type byPublishDate []githubRelease
+
+func (a byPublishDate) Len() int           { return len(a) }
+func (a byPublishDate) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byPublishDate) Less(i, j int) bool { return a[i].PublishedAt > a[j].PublishedAt }
+
+// selectRelease picks the release with the given tag or, without a tag, the
+// most recently published one. Drafts are always ignored, prereleases
+// unless they are allowed or explicitly asked for.
+func selectRelease(releases []githubRelease, tag string, prerelease bool) (*githubRelease, error) {
+	candidates := []githubRelease{}
+	for _, r := range releases {
+		if r.Draft {
+			continue
+		}
+
+		if tag != "" {
+			if r.TagName == tag {
+				return &r, nil
+			}
+			continue
+		}
+
+		if r.Prerelease && !prerelease {
+			continue
+		}
+		candidates = append(candidates, r)
+	}
+
+	if tag != "" {
+		return nil, fmt.Errorf("Release %s not found.", tag)
+	}
+
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("No releases found.")
+	}
+
+	sort.Stable(byPublishDate(candidates))
+	return &candidates[0], nil
+}
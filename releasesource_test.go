@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testReleaseList = `[
+  {"tag_name": "v8", "prerelease": true, "published_at": "2017-03-01T10:00:00Z", "assets": []},
+  {"tag_name": "v9", "draft": true, "published_at": "2017-04-01T10:00:00Z", "assets": []},
+  {"tag_name": "v7", "published_at": "2017-02-01T10:00:00Z", "assets": [
+    {"name": "platconf-linux-amd64", "browser_download_url": "v7/platconf-linux-amd64"},
+    {"name": "SHA256SUMS", "browser_download_url": "https://example.com/v7/SHA256SUMS"}
+  ]},
+  {"tag_name": "v6", "published_at": "2017-01-01T10:00:00Z", "assets": []}
+]`
+
+func TestFetchReleasesHTTP(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/platconf/index.json", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testReleaseList)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	releases, err := fetchReleases(srv.URL + "/platconf/index.json")
+	assert.Nil(t, err)
+	assert.Len(t, releases, 4)
+	assert.Equal(t, srv.URL+"/platconf/v7/platconf-linux-amd64", releases[2].Assets[0].BrowserDownloadURL)
+	assert.Equal(t, "https://example.com/v7/SHA256SUMS", releases[2].Assets[1].BrowserDownloadURL)
+}
+
+func TestFetchReleasesFile(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "platconf-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	listPath := path.Join(tempDir, "releases.json")
+	err = ioutil.WriteFile(listPath, []byte(testReleaseList), 0644)
+	assert.Nil(t, err)
+
+	releases, err := fetchReleases(listPath)
+	assert.Nil(t, err)
+	assert.Len(t, releases, 4)
+	assert.Equal(t, "file://"+tempDir+"/v7/platconf-linux-amd64", releases[2].Assets[0].BrowserDownloadURL)
+
+	// the assets can be downloaded from the same place
+	err = ioutil.WriteFile(path.Join(tempDir, "SHA256SUMS"), []byte("foo"), 0644)
+	assert.Nil(t, err)
+	data, err := fetchSmallAsset("file://" + tempDir + "/SHA256SUMS")
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", string(data))
+
+	_, err = fetchReleases("ftp://example.com/releases.json")
+	assert.NotNil(t, err)
+}
+
+func TestFetchReleasesRateLimit(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/foo/platconf/releases", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "per_page=100", r.URL.RawQuery)
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", fmt.Sprintf("%d", time.Now().Add(time.Hour).Unix()))
+		w.WriteHeader(http.StatusForbidden)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	_, err := fetchReleases(srv.URL + "/repos/foo/platconf/releases")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "rate limit")
+}
+
+func TestSelfupdateClientTimeout(t *testing.T) {
+	block := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/SHA256SUMS", func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	defer close(block)
+
+	assert.Equal(t, selfupdateTimeout, selfupdateClient.Timeout)
+	defer func(timeout time.Duration) { selfupdateClient.Timeout = timeout }(selfupdateClient.Timeout)
+	selfupdateClient.Timeout = 50 * time.Millisecond
+
+	_, err := fetchSmallAsset(srv.URL + "/SHA256SUMS")
+	assert.NotNil(t, err)
+}
+
+func TestSelectRelease(t *testing.T) {
+	releases := []githubRelease{
+		{TagName: "v8", Prerelease: true, PublishedAt: "2017-03-01T10:00:00Z"},
+		{TagName: "v9", Draft: true, PublishedAt: "2017-04-01T10:00:00Z"},
+		{TagName: "v7", PublishedAt: "2017-02-01T10:00:00Z"},
+		{TagName: "v6", PublishedAt: "2017-01-01T10:00:00Z"},
+	}
+
+	release, err := selectRelease(releases, "", false)
+	assert.Nil(t, err)
+	assert.Equal(t, "v7", release.TagName)
+
+	release, err = selectRelease(releases, "", true)
+	assert.Nil(t, err)
+	assert.Equal(t, "v8", release.TagName)
+
+	release, err = selectRelease(releases, "v6", false)
+	assert.Nil(t, err)
+	assert.Equal(t, "v6", release.TagName)
+
+	// explicitly requested prereleases are fine, drafts never
+	release, err = selectRelease(releases, "v8", false)
+	assert.Nil(t, err)
+	assert.Equal(t, "v8", release.TagName)
+
+	_, err = selectRelease(releases, "v9", true)
+	assert.NotNil(t, err)
+
+	_, err = selectRelease(releases[:2], "", false)
+	assert.NotNil(t, err)
+}
@@ -1,14 +1,29 @@
 package main
 
 import (
-	"encoding/json"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"os/exec"
 	"path"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
 )
 
+// smokeTestTimeout is how long the new binary may take to report its version
+const smokeTestTimeout = 10 * time.Second
+
+// nobodyID is the UID and GID the new binary is tested with
+const nobodyID = 65534
+
 type githubReleaseAsset struct {
 	URL                string `json:"url"`
 	ID                 int    `json:"id"`
@@ -45,11 +60,29 @@ type githubRelease struct {
 }
 
 type selfupdateOpts struct {
-	Force bool `short:"f" long:"force" description:"Force installing the current latest release"`
+	Force          bool   `short:"f" long:"force" description:"Force installing the current latest release"`
+	Rollback       bool   `long:"rollback" description:"Restore the binary replaced by the last self-update"`
+	Version        string `long:"version" description:"Install the release with this tag instead of the latest one"`
+	Prerelease     bool   `long:"prerelease" description:"Consider prereleases when looking for the latest release"`
+	AllowDowngrade bool   `long:"allow-downgrade" description:"Install the release even if it is older than the running version"`
+
+	InsecureSkipSignature bool `long:"insecure-skip-signature" description:"Install the release without verifying its signature if the binary has no public key to verify it with. Only the checksum protects the download then"`
 }
 
 func (o *selfupdateOpts) Execute(args []string) error {
-	err := runSelfUpdate(o.Force)
+	if o.Rollback {
+		requireRoot()
+		err := rollbackBinary(opts.Config.SelfupdateTarget)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		fmt.Println("Rollback completed successfully.")
+		return nil
+	}
+
+	err := runSelfUpdate(o)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
@@ -58,36 +91,68 @@ func (o *selfupdateOpts) Execute(args []string) error {
 	return nil
 }
 
-func runSelfUpdate(force bool) error {
+func runSelfUpdate(o *selfupdateOpts) error {
+	force := o.Force
+	version := o.Version
 	if force {
 		fmt.Println("Forcing a self-update.")
 	}
 
-	if VersionTag == "" && !force {
+	if VersionTag == "" && version == "" && !force {
 		fmt.Println("Running a development binary, skipping update.")
 		return nil
 	}
 
-	latestRelease, err := getLatestPlatconfRelease()
+	releases, err := fetchReleases(opts.Config.SelfupdateSource)
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("Latest release is %s\n", latestRelease.TagName)
+	latestRelease, err := selectRelease(releases, version, o.Prerelease)
+	if err != nil {
+		return err
+	}
 
-	if latestRelease.TagName == VersionTag && !force {
-		fmt.Println("Already up-to-date.")
-		return nil
+	if version != "" {
+		fmt.Printf("Requested release is %s\n", latestRelease.TagName)
+	} else {
+		fmt.Printf("Latest release is %s\n", latestRelease.TagName)
+	}
+
+	if VersionTag != "" {
+		cmp, err := compareTags(latestRelease.TagName, VersionTag)
+		switch {
+		case err != nil && !force:
+			return fmt.Errorf("Can't compare release %s with the running version %s: %s. Use --force to install it anyway.", latestRelease.TagName, VersionTag, err.Error())
+		case err == nil && cmp == 0 && !force:
+			fmt.Println("Already up-to-date.")
+			return nil
+		case err == nil && cmp < 0 && !o.AllowDowngrade:
+			return fmt.Errorf("Release %s is older than the running version %s, refusing to downgrade. Use --allow-downgrade to install it anyway.", latestRelease.TagName, VersionTag)
+		}
+	}
+
+	binaryAsset, checksumAsset, signatureAsset, err := selectReleaseAssets(latestRelease, runtime.GOOS, runtime.GOARCH)
+	if err != nil {
+		return err
 	}
 
-	if len(latestRelease.Assets) != 1 {
-		return fmt.Errorf("Latest release has %d assets. Cancelling.", len(latestRelease.Assets))
+	checksums, err := fetchVerifiedChecksums(checksumAsset.BrowserDownloadURL, signatureAsset.BrowserDownloadURL, o.InsecureSkipSignature)
+	if err == ErrNoPublicKey {
+		return fmt.Errorf("Failed to verify the release checksums: %s, use --insecure-skip-signature to install the release without verifying its signature", err.Error())
+	} else if err != nil {
+		return fmt.Errorf("Failed to verify the release checksums: %s", err.Error())
+	}
+
+	expectedChecksum, ok := checksums[binaryAsset.Name]
+	if !ok {
+		return fmt.Errorf("The release checksums don't include '%s'. Cancelling.", binaryAsset.Name)
 	}
 
 	// Previous steps made no changes. Now let's check if we're root before we actually try to do something.
 	requireRoot()
 
-	err = installPlatconfFromURL(latestRelease.Assets[0].BrowserDownloadURL)
+	err = installPlatconfFromAsset(binaryAsset, expectedChecksum, latestRelease.TagName, opts.Config.SelfupdateTarget)
 	if err != nil {
 		return err
 	}
@@ -96,38 +161,119 @@ func runSelfUpdate(force bool) error {
 	return nil
 }
 
-func installPlatconfFromURL(url string) error {
-	targetBinaryDir := "/opt/bin"
-	targetBinaryFullPath := path.Join(targetBinaryDir, "platconf")
+// binaryAssetName returns the name of the binary asset for the given platform
+func binaryAssetName(goos, goarch string) string {
+	return fmt.Sprintf("platconf-%s-%s", goos, goarch)
+}
+
+// isBinaryAsset checks whether the asset looks like a binary
+func isBinaryAsset(asset *githubReleaseAsset) bool {
+	return asset.Size > 0 && !strings.HasPrefix(asset.ContentType, "text/")
+}
+
+// selectReleaseAssets finds the binary for the given platform, the checksum
+// file and its signature among the assets of a release. Releases predating
+// multi-platform builds contain a single linux/amd64 binary with an arbitrary
+// name, which is used if no asset matches the platform.
+func selectReleaseAssets(release *githubRelease, goos, goarch string) (binary, checksum, signature *githubReleaseAsset, err error) {
+	wantedName := binaryAssetName(goos, goarch)
+	var others []*githubReleaseAsset
+	for i := range release.Assets {
+		asset := &release.Assets[i]
+		switch {
+		case asset.Name == checksumAssetName:
+			checksum = asset
+		case asset.Name == signatureAssetName:
+			signature = asset
+		case asset.Name == wantedName:
+			binary = asset
+		case !strings.HasPrefix(asset.Name, "platconf-") || !strings.Contains(asset.Name[len("platconf-"):], "-"):
+			// this includes our own legacy naming, i.e. 'platconf-v6'
+			others = append(others, asset)
+		}
+	}
+
+	if checksum == nil || signature == nil {
+		return nil, nil, nil, fmt.Errorf("Release %s has no '%s' or '%s'. Cancelling.", release.TagName, checksumAssetName, signatureAssetName)
+	}
+
+	if binary == nil && goos == "linux" && goarch == "amd64" && len(others) == 1 {
+		binary = others[0]
+	}
+
+	if binary == nil {
+		return nil, nil, nil, fmt.Errorf("Release %s has no binary for %s/%s. Cancelling.", release.TagName, goos, goarch)
+	}
+
+	if !isBinaryAsset(binary) {
+		return nil, nil, nil, fmt.Errorf("Asset '%s' of release %s is not a binary (%s, %d bytes). Cancelling.", binary.Name, release.TagName, binary.ContentType, binary.Size)
+	}
+
+	return binary, checksum, signature, nil
+}
+
+// installPlatconfFromAsset downloads the binary, verifies its size and
+// checksum, checks that it runs and reports the expected version and
+// installs it in place of the current one, which is kept as a backup.
+func installPlatconfFromAsset(asset *githubReleaseAsset, expectedChecksum, expectedTag, targetBinaryFullPath string) error {
+	url := asset.BrowserDownloadURL
+	expectedSize := int64(asset.Size)
+	targetBinaryDir := path.Dir(targetBinaryFullPath)
 	tempFileFullPath := path.Join(targetBinaryDir, "platconf-download.tmp")
 
 	// first we download the binary from github release assets to a temporary file
 	tempFile, err := os.OpenFile(tempFileFullPath, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0755)
 	if err != nil {
-		return fmt.Errorf("installPlatconfFromURL: OpenFile: %s", err.Error())
+		return fmt.Errorf("installPlatconfFromAsset: OpenFile: %s", err.Error())
 	}
 	defer os.Remove(tempFileFullPath)
 	defer tempFile.Close()
 
 	fmt.Printf("Downloading new binary to '%s'\n", tempFileFullPath)
 
-	resp, err := http.Get(url)
+	resp, err := selfupdateClient.Get(url)
 	if err != nil {
-		return fmt.Errorf("installPlatconfFromURL: http.Get: %s", err.Error())
+		return fmt.Errorf("installPlatconfFromAsset: Get: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("installPlatconfFromAsset: download returned status code %d", resp.StatusCode)
 	}
 
-	_, err = io.Copy(tempFile, resp.Body)
+	if resp.ContentLength >= 0 && resp.ContentLength != expectedSize {
+		return fmt.Errorf("installPlatconfFromAsset: content length is %d, expected %d", resp.ContentLength, expectedSize)
+	}
+
+	hash := sha256.New()
+	written, err := io.Copy(io.MultiWriter(tempFile, hash), &limitedReader{R: resp.Body, N: expectedSize})
 	if err != nil {
-		return fmt.Errorf("installPlatconfFromURL: Copy: %s", err.Error())
+		return fmt.Errorf("installPlatconfFromAsset: Copy: %s", err.Error())
+	}
+
+	if written != expectedSize {
+		return fmt.Errorf("installPlatconfFromAsset: downloaded %d bytes, expected %d", written, expectedSize)
 	}
 
+	actualChecksum := hex.EncodeToString(hash.Sum(nil))
+	if actualChecksum != expectedChecksum {
+		return fmt.Errorf("installPlatconfFromAsset: checksum mismatch, got %s, expected %s", actualChecksum, expectedChecksum)
+	}
+	fmt.Println("Checksum OK.")
+
 	err = tempFile.Sync()
 	if err != nil {
-		return fmt.Errorf("installPlatconfFromURL: Sync: %s", err.Error())
+		return fmt.Errorf("installPlatconfFromAsset: Sync: %s", err.Error())
 	}
 
 	tempFile.Close()
 
+	fmt.Println("Testing the new binary")
+	err = smokeTestBinary(tempFileFullPath, expectedTag)
+	if err != nil {
+		return fmt.Errorf("installPlatconfFromAsset: the new binary failed the test: %s", err.Error())
+	}
+
 	// Now we relink the new file under the old binary's path.
 	// We cannot just write to the destination path directly for two reasons:
 	// 1. If we fail halfway through the operation, we have no working platconf.
@@ -136,38 +282,92 @@ func installPlatconfFromURL(url string) error {
 	fmt.Printf("Installing the new binary to '%s'\n", targetBinaryFullPath)
 	err = os.MkdirAll(targetBinaryDir, 0755)
 	if err != nil {
-		return fmt.Errorf("installPlatconfFromURL: MkdirAll: %s", err.Error())
+		return fmt.Errorf("installPlatconfFromAsset: MkdirAll: %s", err.Error())
+	}
+
+	err = backupBinary(targetBinaryFullPath)
+	if err != nil {
+		return fmt.Errorf("installPlatconfFromAsset: backing up the current binary: %s", err.Error())
 	}
 
 	err = os.Rename(tempFileFullPath, targetBinaryFullPath)
 	if err != nil {
-		return fmt.Errorf("installPlatconfFromURL: Rename: %s", err.Error())
+		return fmt.Errorf("installPlatconfFromAsset: Rename: %s", err.Error())
 	}
 
 	err = os.Chmod(targetBinaryFullPath, 0755)
 	if err != nil {
-		return fmt.Errorf("installPlatconfFromURL: Chmod: %s", err.Error())
+		return fmt.Errorf("installPlatconfFromAsset: Chmod: %s", err.Error())
 	}
 
 	return nil
 }
 
-func getLatestPlatconfRelease() (*githubRelease, error) {
-	resp, err := http.Get("https://api.github.com/repos/experimental-platform/platconf/releases/latest")
+// smokeTestBinary runs 'version' with the given binary and checks whether
+// it reports the expected tag. The binary runs with an empty environment
+// and, if we are root, as 'nobody'. The config file may not be readable
+// by 'nobody', so it's pointed at an empty one.
+func smokeTestBinary(binaryPath, expectedTag string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), smokeTestTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, binaryPath, "version")
+	cmd.Dir = "/"
+	cmd.Env = []string{"PATH=/usr/sbin:/usr/bin:/sbin:/bin", "PLATCONF_CONFIG=/dev/null"}
+	if os.Getuid() == 0 {
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential: &syscall.Credential{Uid: nobodyID, Gid: nobodyID},
+		}
+	}
+
+	output, err := cmd.Output()
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("running '%s version': %s", binaryPath, err.Error())
+	}
+
+	expectedLine := fmt.Sprintf("Platform Configurator release %s", expectedTag)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == expectedLine {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("the binary didn't report version %s", expectedTag)
+}
+
+// previousBinaryPath is where the binary replaced by a self-update is kept
+func previousBinaryPath(targetBinaryFullPath string) string {
+	return targetBinaryFullPath + ".previous"
+}
+
+// backupBinary keeps a hardlink to the current binary, so it survives
+// being replaced by the new one
+func backupBinary(targetBinaryFullPath string) error {
+	_, err := os.Stat(targetBinaryFullPath)
+	if os.IsNotExist(err) {
+		return nil
 	}
 
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("No releases found.")
+	previous := previousBinaryPath(targetBinaryFullPath)
+	fmt.Printf("Keeping the current binary as '%s'\n", previous)
+
+	err = os.Remove(previous)
+	if err != nil && !os.IsNotExist(err) {
+		return err
 	}
 
-	decoder := json.NewDecoder(resp.Body)
-	var result githubRelease
-	err = decoder.Decode(&result)
+	return os.Link(targetBinaryFullPath, previous)
+}
+
+// rollbackBinary restores the binary replaced by the last self-update
+func rollbackBinary(targetBinaryFullPath string) error {
+	previous := previousBinaryPath(targetBinaryFullPath)
+	_, err := os.Stat(previous)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("rollbackBinary: no previous binary available: %s", err.Error())
 	}
 
-	return &result, nil
+	fmt.Printf("Restoring '%s' from '%s'\n", targetBinaryFullPath, previous)
+	return os.Rename(previous, targetBinaryFullPath)
 }
@@ -1,7 +1,14 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -120,3 +127,160 @@ func TestUnmarshalRelease(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, githubReleaseTestExpectedData, resultData)
 }
+
+func TestSelectReleaseAssets(t *testing.T) {
+	release := githubRelease{
+		TagName: "v7",
+		Assets: []githubReleaseAsset{
+			{Name: "SHA256SUMS", ContentType: "text/plain", Size: 200},
+			{Name: "platconf-linux-amd64", ContentType: "application/octet-stream", Size: 9029046},
+			{Name: "platconf-linux-arm64", ContentType: "application/octet-stream", Size: 8729046},
+			{Name: "SHA256SUMS.sig", ContentType: "application/octet-stream", Size: 72},
+		},
+	}
+
+	binary, checksum, signature, err := selectReleaseAssets(&release, "linux", "amd64")
+	assert.Nil(t, err)
+	assert.Equal(t, "platconf-linux-amd64", binary.Name)
+	assert.Equal(t, "SHA256SUMS", checksum.Name)
+	assert.Equal(t, "SHA256SUMS.sig", signature.Name)
+
+	binary, _, _, err = selectReleaseAssets(&release, "linux", "arm64")
+	assert.Nil(t, err)
+	assert.Equal(t, "platconf-linux-arm64", binary.Name)
+
+	_, _, _, err = selectReleaseAssets(&release, "linux", "arm")
+	assert.NotNil(t, err)
+
+	// an empty upload
+	release.Assets[1].Size = 0
+	_, _, _, err = selectReleaseAssets(&release, "linux", "amd64")
+	assert.NotNil(t, err)
+
+	// no signature
+	release.Assets = release.Assets[:3]
+	_, _, _, err = selectReleaseAssets(&release, "linux", "arm64")
+	assert.NotNil(t, err)
+}
+
+func TestSelectReleaseAssetsLegacy(t *testing.T) {
+	release := githubRelease{
+		TagName: "v6",
+		Assets: []githubReleaseAsset{
+			{Name: "SHA256SUMS", ContentType: "text/plain", Size: 200},
+			{Name: "platconf-v6", ContentType: "application/octet-stream", Size: 9029046},
+			{Name: "SHA256SUMS.sig", ContentType: "application/octet-stream", Size: 72},
+		},
+	}
+
+	binary, _, _, err := selectReleaseAssets(&release, "linux", "amd64")
+	assert.Nil(t, err)
+	assert.Equal(t, "platconf-v6", binary.Name)
+
+	// legacy binaries are amd64 only
+	_, _, _, err = selectReleaseAssets(&release, "linux", "arm64")
+	assert.NotNil(t, err)
+}
+
+func TestInstallPlatconfFromAsset(t *testing.T) {
+	binary := []byte("#!/bin/sh\necho Platform Configurator release v6\n")
+	checksum := "0d2d6e1bbb5d8e5b7c0c4bd3e4d0ae2e5f9b8d0c2ee8a3e2e8c7c0a1d7b0a7f1"
+	hash := sha256.Sum256(binary)
+	goodChecksum := hex.EncodeToString(hash[:])
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/platconf", func(w http.ResponseWriter, r *http.Request) { w.Write(binary) })
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	tempDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+	// the binary might be tested as 'nobody'
+	err = os.Chmod(tempDir, 0755)
+	assert.Nil(t, err)
+	target := path.Join(tempDir, "platconf")
+
+	asset := githubReleaseAsset{
+		BrowserDownloadURL: srv.URL + "/platconf",
+		Size:               len(binary),
+	}
+
+	// wrong checksum
+	err = installPlatconfFromAsset(&asset, checksum, "v6", target)
+	assert.NotNil(t, err)
+	_, err = os.Stat(target)
+	assert.True(t, os.IsNotExist(err))
+
+	// wrong version
+	err = installPlatconfFromAsset(&asset, goodChecksum, "v7", target)
+	assert.NotNil(t, err)
+	_, err = os.Stat(target)
+	assert.True(t, os.IsNotExist(err))
+
+	// not found
+	asset.BrowserDownloadURL = srv.URL + "/nothing"
+	err = installPlatconfFromAsset(&asset, goodChecksum, "v6", target)
+	assert.NotNil(t, err)
+	_, err = os.Stat(target)
+	assert.True(t, os.IsNotExist(err))
+
+	// wrong size
+	asset.BrowserDownloadURL = srv.URL + "/platconf"
+	asset.Size++
+	err = installPlatconfFromAsset(&asset, goodChecksum, "v6", target)
+	assert.NotNil(t, err)
+	asset.Size--
+
+	// an old binary to be replaced
+	err = ioutil.WriteFile(target, []byte("old binary"), 0755)
+	assert.Nil(t, err)
+
+	err = installPlatconfFromAsset(&asset, goodChecksum, "v6", target)
+	assert.Nil(t, err)
+	data, err := ioutil.ReadFile(target)
+	assert.Nil(t, err)
+	assert.Equal(t, binary, data)
+	data, err = ioutil.ReadFile(previousBinaryPath(target))
+	assert.Nil(t, err)
+	assert.Equal(t, "old binary", string(data))
+
+	// and back
+	err = rollbackBinary(target)
+	assert.Nil(t, err)
+	data, err = ioutil.ReadFile(target)
+	assert.Nil(t, err)
+	assert.Equal(t, "old binary", string(data))
+	_, err = os.Stat(previousBinaryPath(target))
+	assert.True(t, os.IsNotExist(err))
+
+	// nothing to roll back to
+	err = rollbackBinary(target)
+	assert.NotNil(t, err)
+}
+
+func TestSmokeTestBinary(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+	// the binary might be tested as 'nobody'
+	err = os.Chmod(tempDir, 0755)
+	assert.Nil(t, err)
+
+	good := path.Join(tempDir, "good")
+	err = ioutil.WriteFile(good, []byte("#!/bin/sh\n[ \"$1\" = version ] && echo Platform Configurator release v6\n"), 0755)
+	assert.Nil(t, err)
+	// the config file of the host isn't read
+	configCheck := path.Join(tempDir, "config-check")
+	err = ioutil.WriteFile(configCheck, []byte("#!/bin/sh\n[ \"$PLATCONF_CONFIG\" = /dev/null ] && echo Platform Configurator release v6\n"), 0755)
+	assert.Nil(t, err)
+	failing := path.Join(tempDir, "failing")
+	err = ioutil.WriteFile(failing, []byte("#!/bin/sh\nexit 1\n"), 0755)
+	assert.Nil(t, err)
+
+	assert.Nil(t, smokeTestBinary(good, "v6"))
+	assert.Nil(t, smokeTestBinary(configCheck, "v6"))
+	assert.NotNil(t, smokeTestBinary(good, "v66"))
+	assert.NotNil(t, smokeTestBinary(failing, "v6"))
+	assert.NotNil(t, smokeTestBinary(path.Join(tempDir, "absent"), "v6"))
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// semVersion is a parsed semantic version, see http://semver.org
+type semVersion struct {
+	Major, Minor, Patch int
+	Prerelease          []string
+}
+
+// parseVersion parses release tags like 'v1.2.3', 'v1.2.3-rc.1' or 'v6'.
+// The leading 'v' and the minor and patch numbers are optional, build
+// metadata is ignored.
+func parseVersion(tag string) (*semVersion, error) {
+	s := strings.TrimPrefix(tag, "v")
+	if i := strings.Index(s, "+"); i >= 0 {
+		s = s[:i]
+	}
+
+	var result semVersion
+	if i := strings.Index(s, "-"); i >= 0 {
+		result.Prerelease = strings.Split(s[i+1:], ".")
+		s = s[:i]
+		for _, p := range result.Prerelease {
+			if p == "" {
+				return nil, fmt.Errorf("parseVersion: '%s' has an empty prerelease identifier", tag)
+			}
+		}
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return nil, fmt.Errorf("parseVersion: '%s' is not a semantic version", tag)
+	}
+
+	numbers := []*int{&result.Major, &result.Minor, &result.Patch}
+	for i, p := range parts {
+		n, err := strconv.ParseUint(p, 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("parseVersion: '%s' is not a semantic version", tag)
+		}
+		*numbers[i] = int(n)
+	}
+
+	return &result, nil
+}
+
+func (v *semVersion) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if len(v.Prerelease) > 0 {
+		s += "-" + strings.Join(v.Prerelease, ".")
+	}
+	return s
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// comparePrereleaseIdentifiers compares numeric identifiers numerically and
+// everything else in ASCII order, numeric ones being lower
+func comparePrereleaseIdentifiers(a, b string) int {
+	an, aErr := strconv.ParseUint(a, 10, 63)
+	bn, bErr := strconv.ParseUint(b, 10, 63)
+	switch {
+	case aErr == nil && bErr == nil:
+		return compareInts(int(an), int(bn))
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	default:
+		return strings.Compare(a, b)
+	}
+}
+
+// Compare returns -1, 0 or 1 if v is lower than, equal to or higher than other
+func (v *semVersion) Compare(other *semVersion) int {
+	if c := compareInts(v.Major, other.Major); c != 0 {
+		return c
+	}
+	if c := compareInts(v.Minor, other.Minor); c != 0 {
+		return c
+	}
+	if c := compareInts(v.Patch, other.Patch); c != 0 {
+		return c
+	}
+
+	// a prerelease is lower than the release itself
+	switch {
+	case len(v.Prerelease) == 0 && len(other.Prerelease) == 0:
+		return 0
+	case len(v.Prerelease) == 0:
+		return 1
+	case len(other.Prerelease) == 0:
+		return -1
+	}
+
+	for i := 0; i < len(v.Prerelease) && i < len(other.Prerelease); i++ {
+		if c := comparePrereleaseIdentifiers(v.Prerelease[i], other.Prerelease[i]); c != 0 {
+			return c
+		}
+	}
+
+	return compareInts(len(v.Prerelease), len(other.Prerelease))
+}
+
+// compareTags compares two release tags as semantic versions
+func compareTags(a, b string) (int, error) {
+	va, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+
+	vb, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+
+	return va.Compare(vb), nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseVersion(t *testing.T) {
+	v, err := parseVersion("v1.2.3-rc.1+build5")
+	assert.Nil(t, err)
+	assert.Equal(t, &semVersion{Major: 1, Minor: 2, Patch: 3, Prerelease: []string{"rc", "1"}}, v)
+	assert.Equal(t, "1.2.3-rc.1", v.String())
+
+	v, err = parseVersion("v6")
+	assert.Nil(t, err)
+	assert.Equal(t, &semVersion{Major: 6}, v)
+
+	for _, tag := range []string{"", "latest", "v1.2.3.4", "v1.-2", "v1.2-", "v1.2-rc..1"} {
+		_, err = parseVersion(tag)
+		assert.NotNil(t, err, tag)
+	}
+}
+
+func TestCompareTags(t *testing.T) {
+	// each tag is lower than the next one
+	ordered := []string{
+		"v1.0.0-alpha",
+		"v1.0.0-alpha.1",
+		"v1.0.0-alpha.beta",
+		"v1.0.0-beta",
+		"v1.0.0-beta.2",
+		"v1.0.0-beta.11",
+		"v1.0.0-rc.1",
+		"v1.0.0",
+		"v1.0.1",
+		"v1.10",
+		"v6",
+		"v10",
+	}
+
+	for i := range ordered {
+		for j := range ordered {
+			cmp, err := compareTags(ordered[i], ordered[j])
+			assert.Nil(t, err)
+			switch {
+			case i < j:
+				assert.Equal(t, -1, cmp, "%s < %s", ordered[i], ordered[j])
+			case i > j:
+				assert.Equal(t, 1, cmp, "%s > %s", ordered[i], ordered[j])
+			default:
+				assert.Equal(t, 0, cmp, "%s == %s", ordered[i], ordered[j])
+			}
+		}
+	}
+
+	cmp, err := compareTags("v6", "6.0.0")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, cmp)
+
+	_, err = compareTags("v6", "nightly")
+	assert.NotNil(t, err)
+}
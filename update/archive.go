@@ -0,0 +1,215 @@
+package update
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/experimental-platform/platconf/platconf"
+)
+
+// keepArchivedReleases is the number of releases kept in the archive,
+// including the installed one
+const keepArchivedReleases = 2
+
+// archivedRelease is a release stored by archiveRelease()
+type archivedRelease struct {
+	Build        int32
+	Dir          string
+	ConfigureDir string
+	archivedAt   int64
+}
+
+func releaseArchiveDir(rootDir string) string {
+	return path.Join(rootDir, dataDir, "releases")
+}
+
+// copyMode is the part of a file mode copied by copyTree, including the
+// setuid, setgid and sticky bits
+const copyMode = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// copyTree recursively copies a directory, preserving symlinks and modes
+func copyTree(dst, src string) error {
+	return filepath.Walk(src, func(srcPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(src, srcPath)
+		if err != nil {
+			return err
+		}
+		dstPath := path.Join(dst, relPath)
+
+		switch {
+		case info.IsDir():
+			err = os.MkdirAll(dstPath, info.Mode().Perm())
+			if err != nil {
+				return err
+			}
+			// the umask applies to MkdirAll and the special bits are dropped
+			return os.Chmod(dstPath, info.Mode()&copyMode)
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(srcPath)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(target, dstPath)
+		case info.Mode().IsRegular():
+			err = copyFile(dstPath, srcPath, info.Mode().Perm())
+			if err != nil {
+				return err
+			}
+			return os.Chmod(dstPath, info.Mode()&copyMode)
+		default:
+			log.Printf("copyTree: skipping '%s', not a regular file\n", srcPath)
+			return nil
+		}
+	})
+}
+
+// storeRelease atomically writes the rendered configure directory, the
+// manifest and any additional files to targetDir
+func storeRelease(targetDir, configureDir string, manifest *platconf.ReleaseManifestV2, files map[string][]byte) error {
+	tempDir := targetDir + ".tmp"
+
+	os.RemoveAll(tempDir)
+	err := os.MkdirAll(tempDir, 0755)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+
+	err = copyTree(path.Join(tempDir, "configure"), configureDir)
+	if err != nil {
+		return err
+	}
+
+	manifestData, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(path.Join(tempDir, "manifest.json"), manifestData, 0644)
+	if err != nil {
+		return err
+	}
+
+	for name, data := range files {
+		err = ioutil.WriteFile(path.Join(tempDir, name), data, 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.RemoveAll(targetDir)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tempDir, targetDir)
+}
+
+// archiveRelease stores the rendered configure directory together with the
+// manifest, so the release can be reinstalled later without downloading it.
+func archiveRelease(rootDir, configureDir string, manifest *platconf.ReleaseManifestV2) error {
+	targetDir := path.Join(releaseArchiveDir(rootDir), fmt.Sprintf("%d", manifest.Build))
+
+	log.Printf("Archiving build %d in '%s'\n", manifest.Build, targetDir)
+
+	err := storeRelease(targetDir, configureDir, manifest, nil)
+	if err != nil {
+		return fmt.Errorf("archiveRelease: %s", err.Error())
+	}
+
+	return pruneArchivedReleases(rootDir)
+}
+
+// listArchivedReleases returns the archived releases, most recently archived first
+func listArchivedReleases(rootDir string) ([]archivedRelease, error) {
+	archiveDir := releaseArchiveDir(rootDir)
+	entries, err := ioutil.ReadDir(archiveDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []archivedRelease{}, nil
+		}
+		return nil, err
+	}
+
+	releases := []archivedRelease{}
+	for _, e := range entries {
+		build, err := strconv.ParseInt(e.Name(), 10, 32)
+		if err != nil || !e.IsDir() {
+			continue
+		}
+
+		releases = append(releases, archivedRelease{
+			Build:        int32(build),
+			Dir:          path.Join(archiveDir, e.Name()),
+			ConfigureDir: path.Join(archiveDir, e.Name(), "configure"),
+			archivedAt:   e.ModTime().UnixNano(),
+		})
+	}
+
+	sort.Sort(byArchiveTime(releases))
+	return releases, nil
+}
+
+type byArchiveTime []archivedRelease
+
+func (a byArchiveTime) Len() int           { return len(a) }
+func (a byArchiveTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byArchiveTime) Less(i, j int) bool { return a[i].archivedAt > a[j].archivedAt }
+
+func pruneArchivedReleases(rootDir string) error {
+	releases, err := listArchivedReleases(rootDir)
+	if err != nil {
+		return err
+	}
+
+	for i := keepArchivedReleases; i < len(releases); i++ {
+		log.Printf("Removing archived build %d\n", releases[i].Build)
+		err = os.RemoveAll(releases[i].Dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getArchivedRelease returns the archived release with the given build number
+// together with its manifest
+func getArchivedRelease(rootDir string, build int32) (*archivedRelease, *platconf.ReleaseManifestV2, error) {
+	releases, err := listArchivedReleases(rootDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, r := range releases {
+		if r.Build != build {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(path.Join(r.Dir, "manifest.json"))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var manifest platconf.ReleaseManifestV2
+		err = json.Unmarshal(data, &manifest)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return &r, &manifest, nil
+	}
+
+	return nil, nil, fmt.Errorf("build %d is not archived", build)
+}
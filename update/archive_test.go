@@ -0,0 +1,97 @@
+package update
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/experimental-platform/platconf/platconf"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopyTree(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(srcDir)
+	dstDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dstDir)
+
+	assert.Nil(t, os.MkdirAll(path.Join(srcDir, "a/b"), 0755))
+	assert.Nil(t, ioutil.WriteFile(path.Join(srcDir, "a/b/script"), []byte("foo"), 0755))
+	assert.Nil(t, os.Symlink("b/script", path.Join(srcDir, "a/link")))
+
+	err = copyTree(path.Join(dstDir, "copy"), srcDir)
+	assert.Nil(t, err)
+
+	data, err := ioutil.ReadFile(path.Join(dstDir, "copy/a/b/script"))
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", string(data))
+
+	info, err := os.Stat(path.Join(dstDir, "copy/a/b/script"))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+
+	target, err := os.Readlink(path.Join(dstDir, "copy/a/link"))
+	assert.Nil(t, err)
+	assert.Equal(t, "b/script", target)
+}
+
+func TestCopyTreeSpecialBits(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(srcDir)
+	dstDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dstDir)
+
+	assert.Nil(t, os.Mkdir(path.Join(srcDir, "tmp"), 0755))
+	assert.Nil(t, os.Chmod(path.Join(srcDir, "tmp"), 0777|os.ModeSticky))
+	assert.Nil(t, ioutil.WriteFile(path.Join(srcDir, "helper"), []byte("foo"), 0755))
+	assert.Nil(t, os.Chmod(path.Join(srcDir, "helper"), 0755|os.ModeSetuid))
+
+	err = copyTree(path.Join(dstDir, "copy"), srcDir)
+	assert.Nil(t, err)
+
+	info, err := os.Stat(path.Join(dstDir, "copy/helper"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0755|os.ModeSetuid, info.Mode()&copyMode)
+
+	info, err = os.Stat(path.Join(dstDir, "copy/tmp"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0777|os.ModeSticky, info.Mode()&copyMode)
+}
+
+func TestArchiveRelease(t *testing.T) {
+	tempRootDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempRootDir)
+	fakeConfigureDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(fakeConfigureDir)
+
+	assert.Nil(t, os.MkdirAll(path.Join(fakeConfigureDir, "services"), 0755))
+	assert.Nil(t, ioutil.WriteFile(path.Join(fakeConfigureDir, "services/foo.service"), []byte("foo"), 0644))
+
+	for _, build := range []int32{100, 200, 150} {
+		err = archiveRelease(tempRootDir, fakeConfigureDir, &platconf.ReleaseManifestV2{Build: build, Codename: "test"})
+		assert.Nil(t, err)
+	}
+
+	releases, err := listArchivedReleases(tempRootDir)
+	assert.Nil(t, err)
+	assert.Len(t, releases, keepArchivedReleases)
+	assert.EqualValues(t, 150, releases[0].Build)
+	assert.EqualValues(t, 200, releases[1].Build)
+
+	release, manifest, err := getArchivedRelease(tempRootDir, 200)
+	assert.Nil(t, err)
+	assert.Equal(t, "test", manifest.Codename)
+	data, err := ioutil.ReadFile(path.Join(release.ConfigureDir, "services/foo.service"))
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", string(data))
+
+	_, _, err = getArchivedRelease(tempRootDir, 100)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,486 @@
+package update
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/experimental-platform/platconf/platconf"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// names of the entries of an update bundle, the images are stored in
+// bundleImageDir as written by 'docker save'
+const (
+	bundleManifestName = "manifest.json"
+	bundleChannelName  = "channel"
+	bundleImageDir     = "images"
+	bundleIndexName    = "SHA256SUMS"
+)
+
+// BundleOpts contains the subcommands of the 'bundle' command
+type BundleOpts struct {
+	Create bundleCreateOpts `command:"create" description:"Write an offline update bundle"`
+}
+
+type bundleCreateOpts struct {
+	Channel  string `short:"c" long:"channel" description:"Channel whose latest release is bundled. With --manifest the channel recorded in the bundle, none is recorded without it"`
+	Manifest string `short:"m" long:"manifest" description:"Path to a v2 release manifest to bundle instead of the channel's"`
+	Output   string `short:"o" long:"output" description:"Path of the bundle" required:"true"`
+
+	DownloadRate   string `long:"download-rate" description:"Limit the image downloads to this many bytes per second, with an optional K, M or G suffix"`
+	DownloadWindow string `long:"download-window" description:"Only download images during this daily time window in local time, e.g. '22:00-06:00'. The pull timeout doesn't apply then"`
+
+	ManifestTimeout time.Duration `long:"manifest-timeout" description:"Timeout for fetching the release manifest, 0 disables it" default:"2m"`
+
+	PullOpts
+
+	Config *platconf.Config `no-flag:"true"`
+}
+
+// bundleContents describes a verified bundle
+type bundleContents struct {
+	Manifest *platconf.ReleaseManifestV2
+	Channel  string
+	// the names of the image archives in the bundle
+	Images []string
+}
+
+// bundleImageName returns the name of an image's archive inside the bundle
+func bundleImageName(img platconf.ReleaseManifestV2Image) string {
+	name := strings.NewReplacer("/", "_", ":", "_").Replace(img.Name)
+	return path.Join(bundleImageDir, fmt.Sprintf("%s_%s.tar", name, img.Tag))
+}
+
+// addBundleFile writes a file to the bundle and records its checksum
+func addBundleFile(tw *tar.Writer, index map[string]string, name string, data io.Reader, size int64) error {
+	header := tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	}
+
+	err := tw.WriteHeader(&header)
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	written, err := io.Copy(io.MultiWriter(tw, hash), data)
+	if err != nil {
+		return err
+	}
+	if written != size {
+		return fmt.Errorf("wrote %d bytes of '%s', expected %d", written, name, size)
+	}
+
+	index[name] = hex.EncodeToString(hash.Sum(nil))
+	return nil
+}
+
+// addBundleImage saves an image to a temporary file next to the bundle,
+// as the size of the archive needs to be known before it can be added
+func addBundleImage(ctx context.Context, tw *tar.Writer, index map[string]string, img platconf.ReleaseManifestV2Image, spoolDir string) error {
+	spool, err := ioutil.TempFile(spoolDir, "platconf-image-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	err = saveCanonicalDockerImage(ctx, img.Name, img.Tag, spool)
+	if err != nil {
+		return err
+	}
+
+	size, err := spool.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	_, err = spool.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	return addBundleFile(tw, index, bundleImageName(img), spool, size)
+}
+
+// formatBundleIndex writes the checksums in the format of sha256sum
+func formatBundleIndex(index map[string]string) []byte {
+	names := []string{}
+	for name := range index {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s  %s\n", index[name], name)
+	}
+
+	return buf.Bytes()
+}
+
+func parseBundleIndex(data []byte) (map[string]string, error) {
+	index := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 || len(fields[0]) != sha256.Size*2 {
+			return nil, fmt.Errorf("malformed checksum line '%s'", scanner.Text())
+		}
+		index[fields[1]] = fields[0]
+	}
+
+	return index, scanner.Err()
+}
+
+// createBundle writes the manifest and all of its images, which have to be
+// pulled already, into a single archive at outputPath. An empty channel is
+// recorded if the bundle isn't bound to a channel.
+func createBundle(ctx context.Context, manifest *platconf.ReleaseManifestV2, channel, outputPath string) error {
+	tempPath := outputPath + ".tmp"
+	f, err := os.Create(tempPath)
+	if err != nil {
+		return fmt.Errorf("createBundle: %s", err.Error())
+	}
+	defer os.Remove(tempPath)
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	index := make(map[string]string)
+
+	manifestData, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	err = addBundleFile(tw, index, bundleManifestName, bytes.NewReader(manifestData), int64(len(manifestData)))
+	if err != nil {
+		return fmt.Errorf("createBundle: %s", err.Error())
+	}
+
+	err = addBundleFile(tw, index, bundleChannelName, strings.NewReader(channel), int64(len(channel)))
+	if err != nil {
+		return fmt.Errorf("createBundle: %s", err.Error())
+	}
+
+	for _, img := range manifest.Images {
+		log.Printf("Adding '%s:%s'\n", img.Name, img.Tag)
+		err = addBundleImage(ctx, tw, index, img, path.Dir(outputPath))
+		if err != nil {
+			return fmt.Errorf("createBundle: adding '%s:%s': %s", img.Name, img.Tag, err.Error())
+		}
+	}
+
+	indexData := formatBundleIndex(index)
+	err = addBundleFile(tw, make(map[string]string), bundleIndexName, bytes.NewReader(indexData), int64(len(indexData)))
+	if err != nil {
+		return fmt.Errorf("createBundle: %s", err.Error())
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return fmt.Errorf("createBundle: %s", err.Error())
+	}
+
+	err = f.Sync()
+	if err != nil {
+		return fmt.Errorf("createBundle: %s", err.Error())
+	}
+
+	return os.Rename(tempPath, outputPath)
+}
+
+// verifyBundle reads the whole bundle, checks every entry against the
+// checksum index and returns its manifest. Nothing is loaded yet.
+func verifyBundle(bundlePath string) (*bundleContents, error) {
+	f, err := os.Open(bundlePath)
+	if err != nil {
+		return nil, fmt.Errorf("verifyBundle: %s", err.Error())
+	}
+	defer f.Close()
+
+	actual := make(map[string]string)
+	var manifestData, channelData, indexData []byte
+
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("verifyBundle: %s", err.Error())
+		}
+
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			return nil, fmt.Errorf("verifyBundle: unexpected entry '%s'", header.Name)
+		}
+
+		if _, ok := actual[header.Name]; ok || (header.Name == bundleIndexName && indexData != nil) {
+			return nil, fmt.Errorf("verifyBundle: duplicate entry '%s'", header.Name)
+		}
+
+		switch header.Name {
+		case bundleIndexName:
+			indexData, err = ioutil.ReadAll(&io.LimitedReader{R: tr, N: 1024 * 1024})
+			if err != nil {
+				return nil, fmt.Errorf("verifyBundle: %s", err.Error())
+			}
+			continue
+		case bundleManifestName:
+			manifestData, err = ioutil.ReadAll(&io.LimitedReader{R: tr, N: 1024 * 1024})
+			actual[header.Name] = sha256Hex(manifestData)
+		case bundleChannelName:
+			channelData, err = ioutil.ReadAll(&io.LimitedReader{R: tr, N: 1024})
+			actual[header.Name] = sha256Hex(channelData)
+		default:
+			hash := sha256.New()
+			_, err = io.Copy(hash, tr)
+			actual[header.Name] = hex.EncodeToString(hash.Sum(nil))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("verifyBundle: reading '%s': %s", header.Name, err.Error())
+		}
+	}
+
+	if indexData == nil || manifestData == nil {
+		return nil, fmt.Errorf("verifyBundle: '%s' is not an update bundle", bundlePath)
+	}
+
+	expected, err := parseBundleIndex(indexData)
+	if err != nil {
+		return nil, fmt.Errorf("verifyBundle: %s", err.Error())
+	}
+
+	for name, hash := range actual {
+		if expected[name] == "" {
+			return nil, fmt.Errorf("verifyBundle: '%s' is not in the checksum index", name)
+		}
+		if expected[name] != hash {
+			return nil, fmt.Errorf("verifyBundle: checksum mismatch for '%s'", name)
+		}
+	}
+	for name := range expected {
+		if actual[name] == "" {
+			return nil, fmt.Errorf("verifyBundle: '%s' is missing", name)
+		}
+	}
+
+	var manifest platconf.ReleaseManifestV2
+	err = json.Unmarshal(manifestData, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("verifyBundle: parsing the manifest: %s", err.Error())
+	}
+
+	contents := bundleContents{
+		Manifest: &manifest,
+		Channel:  strings.TrimSpace(string(channelData)),
+		Images:   []string{},
+	}
+	for _, img := range manifest.Images {
+		name := bundleImageName(img)
+		if actual[name] == "" {
+			return nil, fmt.Errorf("verifyBundle: image '%s:%s' is missing", img.Name, img.Tag)
+		}
+		contents.Images = append(contents.Images, name)
+	}
+
+	return &contents, nil
+}
+
+func sha256Hex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// loadBundleImages loads the images of a verified bundle into Docker
+func loadBundleImages(ctx context.Context, bundlePath string, contents *bundleContents) error {
+	client, err := docker.NewClientFromEnv()
+	if err != nil {
+		return err
+	}
+
+	wanted := make(map[string]bool)
+	for _, name := range contents.Images {
+		wanted[name] = true
+	}
+
+	f, err := os.Open(bundlePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if !wanted[header.Name] {
+			continue
+		}
+
+		log.Printf("Loading '%s'\n", header.Name)
+		err = client.LoadImage(docker.LoadImageOptions{InputStream: tr, Context: ctx})
+		if err != nil {
+			return fmt.Errorf("loadBundleImages: loading '%s': %s", header.Name, err.Error())
+		}
+	}
+
+	// the images are bundled under their names in the manifest, the units
+	// of a host using a registry mirror refer to the mirrored ones
+	for source, opts := range mirrorTags(contents.Manifest) {
+		opts.Context = ctx
+		err = client.TagImage(source, opts)
+		if err != nil {
+			return fmt.Errorf("loadBundleImages: tagging '%s': %s", source, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// mirrorTags returns the tags to be added to the loaded images, by the
+// names they have been bundled with
+func mirrorTags(manifest *platconf.ReleaseManifestV2) map[string]docker.TagImageOptions {
+	tags := make(map[string]docker.TagImageOptions)
+	for _, img := range manifest.Images {
+		if mirrored := mirroredImageName(img.Name); mirrored != img.Name {
+			tags[fmt.Sprintf("%s:%s", img.Name, img.Tag)] = docker.TagImageOptions{Repo: mirrored, Tag: img.Tag, Force: true}
+		}
+	}
+
+	return tags
+}
+
+// loadBundle verifies a bundle and loads its images, it returns the manifest
+// and the channel the bundle was created for
+func loadBundle(ctx context.Context, bundlePath string) (*platconf.ReleaseManifestV2, string, error) {
+	log.Printf("Verifying the bundle '%s'\n", bundlePath)
+	contents, err := verifyBundle(bundlePath)
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = loadBundleImages(ctx, bundlePath, contents)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return contents.Manifest, contents.Channel, nil
+}
+
+// bundleChannel returns the channel the box is switched to when installing a
+// bundle recorded for the given channel. The channel file is kept, which an
+// empty channel stands for, unless another channel has been requested
+// explicitly, which has to match the recorded one.
+func bundleChannel(requested, recorded string) (string, error) {
+	if requested != "" && recorded != "" && requested != recorded {
+		return "", fmt.Errorf("the bundle was created for channel '%s', not '%s'", recorded, requested)
+	}
+
+	return requested, nil
+}
+
+// Execute is the function ran when the 'bundle create' command is used
+func (o *bundleCreateOpts) Execute(args []string) error {
+	os.Setenv("DOCKER_API_VERSION", "1.22")
+	applyConfig(o.Config)
+
+	if o.Pullers < 1 {
+		return fmt.Errorf("The maximum number of pullers must be > 0")
+	}
+
+	schedule, err := newDownloadSchedule(o.DownloadRate, o.DownloadWindow)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	var manifest *platconf.ReleaseManifestV2
+	var channel string
+	if o.Manifest != "" {
+		// the host's channel has nothing to do with the given manifest
+		channel = o.Channel
+
+		data, err := ioutil.ReadFile(o.Manifest)
+		if err != nil {
+			return err
+		}
+
+		manifest = &platconf.ReleaseManifestV2{}
+		err = json.Unmarshal(data, manifest)
+		if err != nil {
+			return fmt.Errorf("Failed to parse '%s': %s", o.Manifest, err.Error())
+		}
+	} else {
+		channel, _ = getChannel(o.Channel)
+		manifestCtx, cancel := phaseContext(ctx, o.ManifestTimeout)
+		manifest, err = fetchReleaseData(manifestCtx, channel)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+
+	if manifest.GetImageByName("quay.io/experimentalplatform/configure") == nil {
+		return fmt.Errorf("configure image data not found in the manifest")
+	}
+
+	if channel != "" {
+		log.Printf("Bundling build %d of channel '%s'\n", manifest.Build, channel)
+	} else {
+		log.Printf("Bundling build %d without a channel\n", manifest.Build)
+	}
+
+	// waiting for the download window may take longer than any pull timeout
+	pullTimeout := o.PullTimeout
+	if o.DownloadWindow != "" {
+		pullTimeout = 0
+	}
+
+	pullCtx, cancelPull := phaseContext(ctx, pullTimeout)
+	err = pullAllImages(pullCtx, manifest, o.Pullers, o.PullRetries, schedule)
+	cancelPull()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to pull the images: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	err = createBundle(ctx, manifest, channel, o.Output)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Bundle written to '%s'\n", o.Output)
+	return nil
+}
@@ -0,0 +1,139 @@
+package update
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/experimental-platform/platconf/platconf"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestBundle writes a bundle with the given files, the checksum index
+// is computed from 'indexed' and may differ from the contents
+func writeTestBundle(t *testing.T, bundlePath string, files, indexed map[string]string) {
+	f, err := os.Create(bundlePath)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	index := make(map[string]string)
+	for name, content := range indexed {
+		index[name] = sha256Hex([]byte(content))
+	}
+	for name, content := range files {
+		err = addBundleFile(tw, make(map[string]string), name, strings.NewReader(content), int64(len(content)))
+		assert.Nil(t, err)
+	}
+
+	indexData := formatBundleIndex(index)
+	err = addBundleFile(tw, make(map[string]string), bundleIndexName, strings.NewReader(string(indexData)), int64(len(indexData)))
+	assert.Nil(t, err)
+	assert.Nil(t, tw.Close())
+}
+
+func TestVerifyBundle(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "platconf-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	manifest := platconf.ReleaseManifestV2{
+		Build: 1234,
+		Images: []platconf.ReleaseManifestV2Image{
+			{Name: "quay.io/experimentalplatform/configure", Tag: "v1"},
+			{Name: "quay.io/experimentalplatform/app", Tag: "v2"},
+		},
+	}
+	manifestData, err := json.Marshal(manifest)
+	assert.Nil(t, err)
+
+	files := map[string]string{
+		bundleManifestName: string(manifestData),
+		bundleChannelName:  "beta",
+		"images/quay.io_experimentalplatform_configure_v1.tar": "configure image",
+		"images/quay.io_experimentalplatform_app_v2.tar":       "app image",
+	}
+
+	bundlePath := path.Join(tempDir, "bundle.tar")
+	writeTestBundle(t, bundlePath, files, files)
+
+	contents, err := verifyBundle(bundlePath)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1234), contents.Manifest.Build)
+	assert.Equal(t, "beta", contents.Channel)
+	assert.Equal(t, []string{
+		"images/quay.io_experimentalplatform_configure_v1.tar",
+		"images/quay.io_experimentalplatform_app_v2.tar",
+	}, contents.Images)
+
+	// modified image
+	modified := make(map[string]string)
+	for name, content := range files {
+		modified[name] = content
+	}
+	modified["images/quay.io_experimentalplatform_app_v2.tar"] = "evil image"
+	writeTestBundle(t, bundlePath, modified, files)
+	_, err = verifyBundle(bundlePath)
+	assert.NotNil(t, err)
+
+	// an entry missing from the bundle
+	missing := make(map[string]string)
+	for name, content := range files {
+		if name != "images/quay.io_experimentalplatform_app_v2.tar" {
+			missing[name] = content
+		}
+	}
+	writeTestBundle(t, bundlePath, missing, files)
+	_, err = verifyBundle(bundlePath)
+	assert.NotNil(t, err)
+
+	// an image missing from both the bundle and the index
+	writeTestBundle(t, bundlePath, missing, missing)
+	_, err = verifyBundle(bundlePath)
+	assert.NotNil(t, err)
+
+	// an entry not in the index
+	writeTestBundle(t, bundlePath, files, missing)
+	_, err = verifyBundle(bundlePath)
+	assert.NotNil(t, err)
+}
+
+func TestMirrorTags(t *testing.T) {
+	manifest := &platconf.ReleaseManifestV2{
+		Images: []platconf.ReleaseManifestV2Image{
+			{Name: "quay.io/experimentalplatform/app", Tag: "v2"},
+			{Name: "example.com/other", Tag: "v1"},
+		},
+	}
+
+	assert.Len(t, mirrorTags(manifest), 0)
+
+	defer func() { registryMirror = "" }()
+	registryMirror = "mirror.local:5000"
+	tags := mirrorTags(manifest)
+	assert.Len(t, tags, 1)
+	assert.Equal(t, "mirror.local:5000/experimentalplatform/app", tags["quay.io/experimentalplatform/app:v2"].Repo)
+	assert.Equal(t, "v2", tags["quay.io/experimentalplatform/app:v2"].Tag)
+}
+
+func TestBundleChannel(t *testing.T) {
+	// the channel file is kept unless a channel is requested
+	channel, err := bundleChannel("", "beta")
+	assert.Nil(t, err)
+	assert.Equal(t, "", channel)
+
+	channel, err = bundleChannel("beta", "beta")
+	assert.Nil(t, err)
+	assert.Equal(t, "beta", channel)
+
+	channel, err = bundleChannel("beta", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "beta", channel)
+
+	_, err = bundleChannel("stable", "beta")
+	assert.NotNil(t, err)
+}
@@ -1,44 +1,178 @@
 package update
 
-import "os"
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
 
-type buttonState string
+	"github.com/experimental-platform/platconf/button"
+)
 
+// the phases which are only shown on the button, the others are statuses.
+// 'idle' is shown when platconf is done and no state has been set with
+// 'platconf button' before.
 const (
-	buttonBusy     buttonState = "b 1000"
-	buttonWarning              = "w 400"
-	buttonError                = "e 400"
-	buttonNoise                = "n 1000"
-	buttonShimmer              = "s 1000"
-	buttonRainbow              = "r 1000"
-	buttonPower                = "p 700"
-	buttonHDD                  = "h 700"
-	buttonStartup              = "u 700"
-	buttonShutdown             = "d 700"
+	phaseOSUpdateSkipped = "os update skipped"
+	phaseRebootPending   = "reboot pending"
+	phaseIdle            = "idle"
 )
 
-func button(state buttonState) error {
-	buttonPath := "/dev/protobutton0"
-	_, err := os.Stat(buttonPath)
+// buttonPhaseNames are the phases which can be mapped to button states
+var buttonPhaseNames = []string{
+	"preparing",
+	"waiting for download window",
+	"downloading",
+	"installing",
+	phaseOSUpdateSkipped,
+	"finalizing",
+	phaseRebootPending,
+	"staged",
+	"done",
+	"failed",
+	phaseIdle,
+}
+
+// defaultButtonPhases maps the phases to button states, the LEDs are left
+// as they are during phases missing from the table
+var defaultButtonPhases = map[string]button.State{
+	"preparing":                   button.Rainbow,
+	"waiting for download window": button.Noise,
+	"downloading":                 button.Busy,
+	"installing":                  button.Shimmer,
+	phaseOSUpdateSkipped:          button.Warning,
+	"finalizing":                  button.HDD,
+	phaseRebootPending:            button.Shutdown,
+	"failed":                      button.Error,
+	phaseIdle:                     button.Power,
+}
+
+// buttonDevice shows the progress of the update, it's set up by applyConfig
+var buttonDevice button.Button = &button.Noop{}
+var buttonPhases = defaultButtonPhases
+
+// lastButtonPhase is the most recent phase, buttonTouched tells whether
+// any phase has been shown on the LEDs
+var lastButtonPhase string
+var buttonTouched bool
+var buttonMutex sync.Mutex
+
+// setupButton selects the configured button driver, falling back to not
+// using the button at all, and the configured phase table
+func setupButton(driver, path, phases string) {
+	b, err := button.New(driver, path)
 	if err != nil {
-		return err
+		log.Printf("WARNING: %s, not using the button\n", err.Error())
+		b = &button.Noop{}
 	}
 
-	buttonDev, err := os.OpenFile(buttonPath, os.O_TRUNC|os.O_WRONLY, 0)
+	buttonDevice = b
+
+	buttonPhases, err = parseButtonPhases(phases)
 	if err != nil {
-		return err
+		log.Printf("WARNING: %s, using the default button states\n", err.Error())
+		buttonPhases = defaultButtonPhases
+	}
+}
+
+// parseButtonPhases applies a comma separated list of 'phase=state' to the
+// default table, the state 'none' leaves the LEDs alone during the phase
+func parseButtonPhases(spec string) (map[string]button.State, error) {
+	phases := make(map[string]button.State)
+	for phase, state := range defaultButtonPhases {
+		phases[phase] = state
+	}
+
+	if strings.TrimSpace(spec) == "" {
+		return phases, nil
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid button phase '%s', expected 'phase=state'", entry)
+		}
+
+		phase := strings.TrimSpace(parts[0])
+		if !isButtonPhase(phase) {
+			return nil, fmt.Errorf("unknown button phase '%s', valid phases are %q", phase, buttonPhaseNames)
+		}
+
+		name := strings.TrimSpace(parts[1])
+		if name == "none" {
+			delete(phases, phase)
+			continue
+		}
+
+		state, err := button.ParseState(name)
+		if err != nil {
+			return nil, err
+		}
+		phases[phase] = state
+	}
+
+	return phases, nil
+}
+
+func isButtonPhase(phase string) bool {
+	for _, p := range buttonPhaseNames {
+		if p == phase {
+			return true
+		}
 	}
-	defer buttonDev.Close()
 
-	_, err = buttonDev.WriteString(string(state) + "\n")
+	return false
+}
+
+// setButton shows the state on the button, a failure doesn't affect the update
+func setButton(state button.State) {
+	err := buttonDevice.Set(state)
 	if err != nil {
-		return err
+		log.Printf("WARNING: failed to set the button to '%s': %s\n", state, err.Error())
 	}
+}
+
+// showButtonPhase shows the state the phase is mapped to
+func showButtonPhase(phase string) {
+	buttonMutex.Lock()
+	defer buttonMutex.Unlock()
 
-	err = buttonDev.Sync()
+	lastButtonPhase = phase
+	state, ok := buttonPhases[phase]
+	if !ok {
+		return
+	}
+
+	buttonTouched = true
+	setButton(state)
+}
+
+// restoreButton shows the state last set with 'platconf button' again, or
+// the idle state if there is none, unless the LEDs haven't been touched or
+// the machine is about to reboot
+func restoreButton() {
+	buttonMutex.Lock()
+	defer buttonMutex.Unlock()
+
+	if !buttonTouched || lastButtonPhase == phaseRebootPending {
+		return
+	}
+
+	state, err := button.LoadState(path.Join(dataDir, button.SavedStateFile))
+	if os.IsNotExist(err) {
+		idle, ok := buttonPhases[phaseIdle]
+		if !ok {
+			return
+		}
+		state, err = idle, nil
+	}
 	if err != nil {
-		return err
+		log.Printf("WARNING: failed to read the previous button state: %s\n", err.Error())
+		return
 	}
 
-	return err
+	buttonTouched = false
+	setButton(state)
 }
@@ -0,0 +1,119 @@
+package update
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/experimental-platform/platconf/button"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseButtonPhases(t *testing.T) {
+	phases, err := parseButtonPhases("")
+	assert.Nil(t, err)
+	assert.Equal(t, defaultButtonPhases, phases)
+
+	phases, err = parseButtonPhases("downloading=noise, finalizing=none,done=power")
+	assert.Nil(t, err)
+	assert.Equal(t, button.Noise, phases["downloading"])
+	assert.Equal(t, button.Power, phases["done"])
+	_, ok := phases["finalizing"]
+	assert.False(t, ok)
+	assert.Equal(t, button.Error, phases["failed"])
+
+	// the defaults stay untouched
+	assert.Equal(t, button.Busy, defaultButtonPhases["downloading"])
+	assert.Equal(t, button.HDD, defaultButtonPhases["finalizing"])
+
+	for _, spec := range []string{"downloading", "foo=busy", "downloading=foo"} {
+		_, err = parseButtonPhases(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
+
+func TestShowButtonPhase(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	defer func(b button.Button, p string) {
+		buttonDevice = b
+		dataDir = p
+		buttonPhases = defaultButtonPhases
+		lastButtonPhase = ""
+		buttonTouched = false
+	}(buttonDevice, dataDir)
+	dataDir = tempDir
+	buttonFile := path.Join(tempDir, "button")
+	setupButton(button.DriverSimulated, buttonFile, "done=none,idle=none")
+
+	readStates := func() string {
+		data, err := ioutil.ReadFile(buttonFile)
+		if os.IsNotExist(err) {
+			return ""
+		}
+		assert.Nil(t, err)
+		return string(data)
+	}
+
+	// nothing shown, nothing to restore
+	showButtonPhase("done")
+	restoreButton()
+	assert.Equal(t, "", readStates())
+
+	showButtonPhase("preparing")
+	showButtonPhase("downloading")
+	assert.Equal(t, "r 1000\nb 1000\n", readStates())
+
+	// no state recorded by 'platconf button' and no idle state
+	restoreButton()
+	assert.Equal(t, "r 1000\nb 1000\n", readStates())
+
+	assert.Nil(t, button.SaveState(path.Join(tempDir, button.SavedStateFile), button.Power))
+	restoreButton()
+	assert.Equal(t, "r 1000\nb 1000\np 700\n", readStates())
+
+	// the machine reboots anyway
+	showButtonPhase("finalizing")
+	showButtonPhase(phaseRebootPending)
+	restoreButton()
+	assert.Equal(t, "r 1000\nb 1000\np 700\nh 700\nd 700\n", readStates())
+}
+
+func TestRestoreButtonIdle(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	defer func(b button.Button, p string) {
+		buttonDevice = b
+		dataDir = p
+		buttonPhases = defaultButtonPhases
+		lastButtonPhase = ""
+		buttonTouched = false
+	}(buttonDevice, dataDir)
+	dataDir = tempDir
+	buttonFile := path.Join(tempDir, "button")
+
+	// e.g. the build is installed already, nothing has been recorded
+	setupButton(button.DriverSimulated, buttonFile, "")
+	showButtonPhase("preparing")
+	showButtonPhase("done")
+	restoreButton()
+
+	data, err := ioutil.ReadFile(buttonFile)
+	assert.Nil(t, err)
+	assert.Equal(t, "r 1000\np 700\n", string(data))
+
+	// the idle state is configurable
+	assert.Nil(t, os.Remove(buttonFile))
+	setupButton(button.DriverSimulated, buttonFile, "idle=shimmer")
+	showButtonPhase("finalizing")
+	restoreButton()
+
+	data, err = ioutil.ReadFile(buttonFile)
+	assert.Nil(t, err)
+	assert.Equal(t, "h 700\ns 1000\n", string(data))
+}
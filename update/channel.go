@@ -3,6 +3,7 @@ package update
 import (
 	"fmt"
 	"io/ioutil"
+	"path"
 )
 
 type channelSource int
@@ -13,10 +14,15 @@ const (
 	csDefault     channelSource = iota
 )
 
-const defaultChannel string = "soul3"
+var defaultChannel = "soul3"
 
 var channelFilePath = "/etc/protonet/system/channel"
 
+// rootChannelFilePath returns the configured channel file below rootDir
+func rootChannelFilePath(rootDir string) string {
+	return path.Join(rootDir, channelFilePath)
+}
+
 func getChannel(commandLineChannel string) (string, channelSource) {
 	// If the channel has been specified on the command line then go with it
 	if commandLineChannel != "" {
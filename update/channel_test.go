@@ -3,8 +3,10 @@ package update
 import (
 	"io/ioutil"
 	"os"
+	"path"
 	"testing"
 
+	"github.com/jarcoal/httpmock"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -55,3 +57,46 @@ func TestGetChannelFromFileDoesntExist(t *testing.T) {
 	assert.Equal(t, defaultChannel, result)
 	assert.Equal(t, csDefault, method)
 }
+
+func TestRootChannelFilePath(t *testing.T) {
+	defer func(p string) { channelFilePath = p }(channelFilePath)
+	channelFilePath = "/etc/platconf/channel"
+
+	assert.Equal(t, "/etc/platconf/channel", rootChannelFilePath("/"))
+	assert.Equal(t, "/tmp/root/etc/platconf/channel", rootChannelFilePath("/tmp/root"))
+
+	// the channel written by the update is the one read by the next one
+	tempRootDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempRootDir)
+	assert.Nil(t, os.MkdirAll(path.Join(tempRootDir, "etc/platconf"), 0755))
+	assert.Nil(t, ioutil.WriteFile(rootChannelFilePath(tempRootDir), []byte("foo"), 0644))
+
+	channelFilePath = rootChannelFilePath(tempRootDir)
+	result, method := getChannel("")
+	assert.Equal(t, "foo", result)
+	assert.Equal(t, csChannelFile, method)
+}
+
+func TestFetchChannelList(t *testing.T) {
+	testBody := `[
+  {"name": "beta.json", "type": "file"},
+  {"name": "soul3.json", "type": "file"},
+  {"name": "README.md", "type": "file"},
+  {"name": "old.json", "type": "dir"},
+  {"name": "alpha.json", "type": "file"}
+]`
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("GET", channelListURL, httpmock.NewStringResponder(200, testBody))
+
+	channels, err := fetchChannelList()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"alpha", "beta", "soul3"}, channels)
+
+	httpmock.RegisterResponder("GET", channelListURL, httpmock.NewStringResponder(403, "rate limited"))
+	_, err = fetchChannelList()
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,172 @@
+package update
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/experimental-platform/platconf/platconf"
+)
+
+// ChannelOpts contains the subcommands of the 'channel' command
+type ChannelOpts struct {
+	List channelListOpts `command:"list" description:"List the available channels"`
+	Show channelShowOpts `command:"show" description:"Show the current channel and its builds"`
+	Set  channelSetOpts  `command:"set" description:"Switch to another channel"`
+}
+
+type channelListOpts struct {
+	Config *platconf.Config `no-flag:"true"`
+}
+
+type channelShowOpts struct {
+	ManifestTimeout time.Duration `long:"manifest-timeout" description:"Timeout for fetching the release manifest, 0 disables it" default:"2m"`
+
+	Config *platconf.Config `no-flag:"true"`
+}
+
+type channelSetOpts struct {
+	Args struct {
+		Channel string `positional-arg-name:"channel" required:"true"`
+	} `positional-args:"true"`
+	ManifestTimeout time.Duration `long:"manifest-timeout" description:"Timeout for fetching the release manifest, 0 disables it" default:"2m"`
+	SystemdTimeout  time.Duration `long:"systemd-timeout" description:"Timeout for restarting the update trigger unit, 0 disables it" default:"5m"`
+
+	Config *platconf.Config `no-flag:"true"`
+}
+
+// githubContentEntry is an entry of the GitHub contents API response,
+// minus the fields we don't need
+type githubContentEntry struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+func (cs channelSource) String() string {
+	switch cs {
+	case csChannelFile:
+		return "channel file"
+	case csCommandLine:
+		return "command line"
+	default:
+		return "default"
+	}
+}
+
+// fetchChannelList returns the names of all channels with a v2 manifest
+func fetchChannelList() ([]string, error) {
+	resp, err := http.Get(channelListURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetchChannelList: response status code was %d", resp.StatusCode)
+	}
+
+	var entries []githubContentEntry
+	err = json.NewDecoder(resp.Body).Decode(&entries)
+	if err != nil {
+		return nil, fmt.Errorf("fetchChannelList: %s", err.Error())
+	}
+
+	channels := []string{}
+	for _, e := range entries {
+		if e.Type == "file" && strings.HasSuffix(e.Name, ".json") {
+			channels = append(channels, strings.TrimSuffix(e.Name, ".json"))
+		}
+	}
+	sort.Strings(channels)
+
+	return channels, nil
+}
+
+func (o *channelListOpts) Execute(args []string) error {
+	applyConfig(o.Config)
+
+	channels, err := fetchChannelList()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	current, _ := getChannel("")
+	for _, c := range channels {
+		if c == current {
+			fmt.Printf("* %s\n", c)
+		} else {
+			fmt.Printf("  %s\n", c)
+		}
+	}
+
+	return nil
+}
+
+func (o *channelShowOpts) Execute(args []string) error {
+	applyConfig(o.Config)
+
+	channel, source := getChannel("")
+	fmt.Printf("Channel:         %s (%s)\n", channel, source)
+
+	build, err := readInstalledBuild("/")
+	if err != nil {
+		fmt.Println("Installed build: unknown")
+	} else {
+		fmt.Printf("Installed build: %d\n", build)
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+	manifestCtx, cancelManifest := phaseContext(ctx, o.ManifestTimeout)
+	defer cancelManifest()
+
+	manifest, err := fetchReleaseData(manifestCtx, channel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to fetch the manifest for channel '%s': %s\n", channel, err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf("Latest build:    %d (%s)\n", manifest.Build, manifest.Codename)
+
+	return nil
+}
+
+func (o *channelSetOpts) Execute(args []string) error {
+	applyConfig(o.Config)
+
+	channel := o.Args.Channel
+	if channel == "" {
+		return errors.New("The channel name must not be empty")
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	// make sure there is a manifest for the channel before switching to it
+	manifestCtx, cancelManifest := phaseContext(ctx, o.ManifestTimeout)
+	manifest, err := fetchReleaseData(manifestCtx, channel)
+	cancelManifest()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Channel '%s' is not available: %s\n", channel, err.Error())
+		os.Exit(1)
+	}
+
+	platconf.RequireRoot()
+	lock := tryLockUpdate(lockfilePath)
+	systemdCtx, cancelSystemd := phaseContext(ctx, o.SystemdTimeout)
+	err = setupChannelFile(systemdCtx, channelFilePath, channel)
+	cancelSystemd()
+	lock.Unlock()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Switched to channel '%s', latest build is %d (%s).\n", channel, manifest.Build, manifest.Codename)
+	return nil
+}
@@ -0,0 +1,56 @@
+package update
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/experimental-platform/platconf/platconf"
+)
+
+// exit codes of 'update --check'
+const (
+	checkUpToDate        = 0
+	checkError           = 1
+	checkUpdateAvailable = 2
+)
+
+// checkForUpdate fetches the manifest for the channel and compares its build
+// with the installed one. A box without an installed release is always
+// considered outdated.
+func checkForUpdate(ctx context.Context, channel, rootDir string) (*platconf.ReleaseManifestV2, bool, error) {
+	releaseData, err := fetchReleaseData(ctx, channel)
+	if err != nil {
+		return nil, false, err
+	}
+
+	installedBuild, err := readInstalledBuild(rootDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return releaseData, true, nil
+		}
+		return nil, false, fmt.Errorf("reading the installed release number: %s", err.Error())
+	}
+
+	return releaseData, installedBuild != releaseData.Build, nil
+}
+
+func runCheck(ctx context.Context, specifiedChannel, rootDir string) int {
+	channel, channelSource := getChannel(specifiedChannel)
+	logChannelDetection(channel, channelSource)
+
+	releaseData, available, err := checkForUpdate(ctx, channel, rootDir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return checkError
+	}
+
+	if !available {
+		fmt.Printf("Up-to-date, build %d (%s) is installed.\n", releaseData.Build, releaseData.Codename)
+		return checkUpToDate
+	}
+
+	fmt.Printf("Update available: build %d (%s)\n", releaseData.Build, releaseData.Codename)
+	fmt.Printf("Release notes: %s\n", releaseData.ReleaseNotesURL)
+	return checkUpdateAvailable
+}
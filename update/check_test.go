@@ -0,0 +1,59 @@
+package update
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckForUpdate(t *testing.T) {
+	testChannel := "WhateverTheF"
+	testBody := `{"build": 1235, "codename": "Kaufman", "url": "https://www.example.com/", "images": []}`
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	mockURL := fmt.Sprintf(manifestURLv2, testChannel)
+	httpmock.RegisterResponder("GET", mockURL, httpmock.NewStringResponder(200, testBody))
+
+	tempDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	// nothing installed
+	manifest, available, err := checkForUpdate(context.Background(), testChannel, tempDir)
+	assert.Nil(t, err)
+	assert.True(t, available)
+	assert.EqualValues(t, 1235, manifest.Build)
+	assert.Equal(t, checkUpdateAvailable, runCheck(context.Background(), testChannel, tempDir))
+
+	err = os.MkdirAll(path.Join(tempDir, "etc/protonet/system"), 0755)
+	assert.Nil(t, err)
+	releaseNumberPath := path.Join(tempDir, "etc/protonet/system/release_number")
+
+	// older build installed
+	err = ioutil.WriteFile(releaseNumberPath, []byte("1234"), 0644)
+	assert.Nil(t, err)
+	_, available, err = checkForUpdate(context.Background(), testChannel, tempDir)
+	assert.Nil(t, err)
+	assert.True(t, available)
+
+	// same build installed
+	err = ioutil.WriteFile(releaseNumberPath, []byte("1235"), 0644)
+	assert.Nil(t, err)
+	_, available, err = checkForUpdate(context.Background(), testChannel, tempDir)
+	assert.Nil(t, err)
+	assert.False(t, available)
+	assert.Equal(t, checkUpToDate, runCheck(context.Background(), testChannel, tempDir))
+
+	// broken release number
+	err = ioutil.WriteFile(releaseNumberPath, []byte("foo"), 0644)
+	assert.Nil(t, err)
+	assert.Equal(t, checkError, runCheck(context.Background(), testChannel, tempDir))
+}
@@ -2,6 +2,8 @@ package update
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -20,6 +22,14 @@ import (
 // an absolute path when a relative path has been passed to them
 var ErrIsRelative = errors.New("a relative path was given")
 
+// unmanagedBinaries are the files in /opt/bin which aren't installed by
+// the update and must be left alone
+var unmanagedBinaries = []string{
+	"protonet_zpool.sh",
+	"platconf",
+	"platconf.previous",
+}
+
 func copyFile(dst, src string, mode os.FileMode) error {
 	// only use absolute paths to prevent epic fails
 	if !path.IsAbs(dst) || !path.IsAbs(src) {
@@ -59,14 +69,26 @@ func copyFile(dst, src string, mode os.FileMode) error {
 	return nil
 }
 
+// installFile copies a file, giving the copy the same permissions as the source
+func installFile(dst, src string) error {
+	srcFileStat, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	mode := srcFileStat.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	err = copyFile(dst, src, mode)
+	if err != nil {
+		return err
+	}
+
+	// the file may have existed before, and the umask applies to new ones
+	return os.Chmod(dst, mode)
+}
+
 func setupUtilityScripts(rootDir, configureDir string) error {
 	binDir := path.Join(rootDir, "opt", "bin")
 	scriptsDir := path.Join(rootDir, "etc", "systemd", "system", "scripts")
-	ignoreScripts := []string{
-		"protonet_zpool.sh",
-		"platconf",
-	}
-
 	binDirContents, err := ioutil.ReadDir(binDir)
 	if err != nil {
 		return err
@@ -82,7 +104,7 @@ removeBindirContents:
 		basename := f.Name()
 
 		// should we leave this one behind?
-		for _, toSkip := range ignoreScripts {
+		for _, toSkip := range unmanagedBinaries {
 			if basename == toSkip {
 				log.Println("setupUtilityScripts: skipping", toSkip)
 				continue removeBindirContents
@@ -128,7 +150,7 @@ removeBindirContents:
 		dst := path.Join(scriptsDir, basename)
 		linkLocation := strings.TrimSuffix(path.Join(binDir, basename), ".sh")
 		log.Println("\t", "*", basename)
-		err = copyFile(dst, fullpath, 0755)
+		err = installFile(dst, fullpath)
 		if err != nil {
 			return fmt.Errorf("setupUtilityScripts: failed to copy file: %s", err.Error())
 		}
@@ -162,7 +184,7 @@ func setupBinaries(rootDir, configureDir string) error {
 		}
 		src := path.Join(configureDir, b)
 		dst := path.Join(binDir, b)
-		err := copyFile(dst, src, 0755)
+		err := installFile(dst, src)
 		if err != nil {
 			return err
 		}
@@ -181,7 +203,7 @@ func setupBinaries(rootDir, configureDir string) error {
 		}
 		dst := path.Join(binDir, b.Name())
 		src := path.Join(configureDir, "binaries", b.Name())
-		err := copyFile(dst, src, 0755)
+		err := installFile(dst, src)
 		if err != nil {
 			return err
 		}
@@ -190,9 +212,7 @@ func setupBinaries(rootDir, configureDir string) error {
 	return nil
 }
 
-func pullAllImages(manifest *platconf.ReleaseManifestV2, maxPullers, maxRetries int) error {
-	// TODO add retry
-
+func pullAllImages(ctx context.Context, manifest *platconf.ReleaseManifestV2, maxPullers, maxRetries int, schedule *downloadSchedule) error {
 	type pullerMsg struct {
 		ImgName string
 		Error   error
@@ -212,18 +232,38 @@ func pullAllImages(manifest *platconf.ReleaseManifestV2, maxPullers, maxRetries
 					return
 				}
 
-				for retry := 1; retry <= maxRetries; retry++ {
-					err := pullImage(img.Name, img.Tag, nil)
+				for retry := 1; retry <= maxRetries; {
+					err := schedule.waitForWindow(ctx)
+					if err != nil {
+						return
+					}
+
+					pullCtx, cancel := schedule.pullContext(ctx)
+					err = pullImageLimited(pullCtx, img.Name, img.Tag, nil, schedule.pullLimiter())
+					windowClosed := pullCtx.Err() != nil && ctx.Err() == nil
+					cancel()
+
+					if windowClosed {
+						// the layers pulled so far are kept, so the pull
+						// continues where it stopped once the window opens
+						log.Printf("Downloading '%s': PAUSED, the download window closed", img.Name)
+						continue
+					}
 
-					pullerChan <- pullerMsg{
+					select {
+					case pullerChan <- pullerMsg{
 						ImgName: img.Name,
-						Error:   nil,
+						Error:   err,
 						Retry:   retry,
+					}:
+					case <-ctx.Done():
+						return
 					}
 
 					if err == nil {
 						continue PullNextImage
 					}
+					retry++
 				}
 			}
 		}()
@@ -231,12 +271,21 @@ func pullAllImages(manifest *platconf.ReleaseManifestV2, maxPullers, maxRetries
 
 	go func() {
 		for _, img := range manifest.Images {
-			imagesChan <- img
+			select {
+			case imagesChan <- img:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
 	for i := 0; i < imagesTotal; {
-		msg := <-pullerChan
+		var msg pullerMsg
+		select {
+		case msg = <-pullerChan:
+		case <-ctx.Done():
+			return fmt.Errorf("pulling the images: %s", ctx.Err().Error())
+		}
 		if msg.Error != nil {
 			if msg.Retry == maxRetries {
 				log.Printf("Downloading '%s': FAILED", msg.ImgName)
@@ -279,12 +328,11 @@ func parseAllTemplates(rootDir, configureDir string, manifest *platconf.ReleaseM
 }
 
 func parseTemplate(path string, manifest *platconf.ReleaseManifestV2) error {
-	imgRegexp := regexp.MustCompile(`quay.io/[a-z]*/[a-z0-9\-]*`)
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return err
 	}
-	match := imgRegexp.FindString(string(data))
+	match := imageReferenceRegexp.FindString(string(data))
 	if match == "" {
 		return nil
 	}
@@ -296,6 +344,7 @@ func parseTemplate(path string, manifest *platconf.ReleaseManifestV2) error {
 
 	tagRegexp := regexp.MustCompile(`{{tag}}`)
 	result := tagRegexp.ReplaceAll(data, []byte(imageManifest.Tag))
+	result = mirrorImageReferences(result)
 
 	err = ioutil.WriteFile(path, result, 0644)
 	if err != nil {
@@ -415,6 +464,32 @@ func removePlatformUnits(dir string) error {
 	return nil
 }
 
+// listPlatformUnits returns the names of all platform units in the given directory
+func listPlatformUnits(dir string) ([]string, error) {
+	if !path.IsAbs(dir) {
+		return nil, ErrIsRelative
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	units := []string{}
+	for _, f := range entries {
+		isPlatform, err := isPlatformUnit(path.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		if isPlatform {
+			units = append(units, f.Name())
+		}
+	}
+
+	return units, nil
+}
+
 func cleanupSystemd(rootDir string) error {
 	systemDir := path.Join(rootDir, "etc/systemd/system")
 	networkDir := path.Join(rootDir, "etc/systemd/network")
@@ -466,7 +541,7 @@ func setupUdev(rootDir, configureDir string) error {
 	return nil
 }
 
-func setupSystemD(rootDir, configureDir string) error {
+func setupSystemD(ctx context.Context, rootDir, configureDir string) error {
 	log.Println("Setting up systemD services")
 
 	// copy normal units
@@ -484,6 +559,12 @@ func setupSystemD(rootDir, configureDir string) error {
 		}
 	}
 
+	// the postboot unit checks the units after the next boot
+	err = installPostbootUnit(rootDir)
+	if err != nil {
+		return err
+	}
+
 	// copy docker log override
 	src := path.Join(configureDir, "config/50-log-warn.conf")
 	dst := path.Join(rootDir, "etc/systemd/system/docker.service.d/50-log-warn.conf")
@@ -527,13 +608,13 @@ func setupSystemD(rootDir, configureDir string) error {
 
 	// reload all the things
 	log.Println("Reloading the config files.")
-	err = systemdDaemonReload()
+	err = systemdDaemonReload(ctx)
 	if err != nil {
 		return err
 	}
 
 	// enable the systemd-networkd-wait-online.service
-	err = systemdEnableUnits([]string{"systemd-networkd-wait-online.service"})
+	err = systemdEnableUnits(ctx, []string{"systemd-networkd-wait-online.service"})
 	if err != nil {
 		return err
 	}
@@ -548,7 +629,7 @@ func setupSystemD(rootDir, configureDir string) error {
 	// TODO maybe do this in one go?
 	for _, u := range units {
 		if !strings.HasSuffix(u.Name(), ".sh") && u.Mode().IsRegular() {
-			err = systemdEnableUnits([]string{u.Name()})
+			err = systemdEnableUnits(ctx, []string{u.Name()})
 			if err != nil {
 				return err
 			}
@@ -558,23 +639,28 @@ func setupSystemD(rootDir, configureDir string) error {
 	return nil
 }
 
-func setupChannelFile(channelFilePath, channel string) error {
+func setupChannelFile(ctx context.Context, channelFilePath, channel string) error {
 	log.Println("Writing the channel file")
 	currentChannel, err := ioutil.ReadFile(channelFilePath)
 	if err == nil && string(currentChannel) == channel {
 		return nil
 	}
 
-	err = systemdDaemonReload()
+	err = systemdDaemonReload(ctx)
 	if err != nil {
 		return err
 	}
 
-	err = systemdStopUnit("trigger-update-protonet.path")
+	err = systemdStopUnit(ctx, "trigger-update-protonet.path")
 	if err != nil {
 		return err
 	}
-	defer systemdRestartUnit("trigger-update-protonet.path")
+	defer func() {
+		// the unit is restarted even if the update has been cancelled
+		restartCtx, cancel := context.WithTimeout(context.Background(), teardownTimeout)
+		defer cancel()
+		systemdRestartUnit(restartCtx, "trigger-update-protonet.path")
+	}()
 
 	return ioutil.WriteFile(channelFilePath, []byte(channel), 0644)
 }
@@ -595,6 +681,16 @@ func finalize(manifest *platconf.ReleaseManifestV2, rootDir string) error {
 		return err
 	}
 
+	manifestData, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(path.Join(rootDir, installedManifestPath), manifestData, 0644)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -46,6 +46,8 @@ func TestSetupUtilityScripts(t *testing.T) {
 	assert.Nil(t, err)
 	err = ioutil.WriteFile(path.Join(fakeConfigureDir, "scripts", "newscript.sh"), []byte("lol"), 0755)
 	assert.Nil(t, err)
+	err = ioutil.WriteFile(path.Join(fakeConfigureDir, "scripts", "private.sh"), []byte("rofl"), 0700)
+	assert.Nil(t, err)
 
 	err = setupUtilityScripts(tempRootDir, fakeConfigureDir)
 	assert.Nil(t, err)
@@ -66,9 +68,13 @@ func TestSetupUtilityScripts(t *testing.T) {
 	assert.NotNil(t, err)
 	assert.True(t, os.IsNotExist(err))
 
-	// test whether the new script got installed
-	_, err = os.Lstat(path.Join(tempRootScriptsDir, "newscript.sh"))
+	// test whether the new scripts got installed with their modes
+	info, err := os.Lstat(path.Join(tempRootScriptsDir, "newscript.sh"))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode())
+	info, err = os.Lstat(path.Join(tempRootScriptsDir, "private.sh"))
 	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode())
 
 	// test whether the new symlink got installed
 	_, err = os.Lstat(path.Join(tempRootBinDir, "newscript"))
@@ -425,3 +431,25 @@ func TestRemovePlatformUnits(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Len(t, fileinfo, 2)
 }
+
+func TestListPlatformUnits(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	_, err = listPlatformUnits("relative/path")
+	assert.Equal(t, ErrIsRelative, err)
+
+	err = ioutil.WriteFile(path.Join(tempDir, "a.service"), []byte("# ExperimentalPlatform\nfoobar"), 0644)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(path.Join(tempDir, "b.service"), []byte("[Unit]\nfoobar"), 0644)
+	assert.Nil(t, err)
+	err = os.Mkdir(path.Join(tempDir, "c.wants"), 0755)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(path.Join(tempDir, "d.timer"), []byte("# ExperimentalPlatform\nfoobar"), 0644)
+	assert.Nil(t, err)
+
+	units, err := listPlatformUnits(tempDir)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a.service", "d.timer"}, units)
+}
@@ -0,0 +1,45 @@
+package update
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// teardownTimeout limits the cleanup done after a phase has been cancelled,
+// e.g. restarting the units stopped while setting up systemd
+const teardownTimeout = 30 * time.Second
+
+// signalContext returns a context that is cancelled on SIGINT or SIGTERM.
+// Only the first signal is caught, a second one kills the process.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Printf("Received %s, cancelling\n", sig.String())
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(signals)
+	}()
+
+	return ctx, cancel
+}
+
+// phaseContext limits a phase of the update to the given timeout,
+// a timeout <= 0 means the phase may run as long as it needs
+func phaseContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
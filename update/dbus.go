@@ -1,19 +1,38 @@
 package update
 
 import (
+	"context"
 	"fmt"
+	"strings"
 
 	dbus "github.com/coreos/go.dbus"
 )
 
-func systemdDaemonReload() error {
+// dbusCaller is implemented by the D-Bus objects
+type dbusCaller interface {
+	Go(method string, flags dbus.Flags, ch chan *dbus.Call, args ...interface{}) *dbus.Call
+}
+
+// callWithContext calls a D-Bus method, giving up waiting for the reply
+// when the context is done
+func callWithContext(ctx context.Context, object dbusCaller, method string, args ...interface{}) *dbus.Call {
+	call := object.Go(method, 0, make(chan *dbus.Call, 1), args...)
+	select {
+	case <-call.Done:
+		return call
+	case <-ctx.Done():
+		return &dbus.Call{Method: method, Err: ctx.Err()}
+	}
+}
+
+func systemdDaemonReload(ctx context.Context) error {
 	conn, err := dbus.SystemBus()
 	if err != nil {
 		return fmt.Errorf("failed to connect to session bus: %s", err.Error())
 	}
 
 	object := conn.Object("org.freedesktop.systemd1", "/org/freedesktop/systemd1")
-	call := object.Call("org.freedesktop.systemd1.Manager.Reload", 0)
+	call := callWithContext(ctx, object, "org.freedesktop.systemd1.Manager.Reload")
 
 	if call.Err != nil {
 		return call.Err
@@ -22,14 +41,14 @@ func systemdDaemonReload() error {
 	return nil
 }
 
-func systemdEnableUnits(units []string) error {
+func systemdEnableUnits(ctx context.Context, units []string) error {
 	conn, err := dbus.SystemBus()
 	if err != nil {
 		return fmt.Errorf("failed to connect to session bus: %s", err.Error())
 	}
 
 	object := conn.Object("org.freedesktop.systemd1", "/org/freedesktop/systemd1")
-	call := object.Call("org.freedesktop.systemd1.Manager.EnableUnitFiles", 0, units, false, true)
+	call := callWithContext(ctx, object, "org.freedesktop.systemd1.Manager.EnableUnitFiles", units, false, true)
 
 	if call.Err != nil {
 		return fmt.Errorf("enabling units %v: %s", units, call.Err.Error())
@@ -38,14 +57,14 @@ func systemdEnableUnits(units []string) error {
 	return nil
 }
 
-func systemdGetUnitPath(unitName string) (dbus.ObjectPath, error) {
+func systemdGetUnitPath(ctx context.Context, unitName string) (dbus.ObjectPath, error) {
 	conn, err := dbus.SystemBus()
 	if err != nil {
 		return "", fmt.Errorf("Failed to connect to session bus: %s", err.Error())
 	}
 
 	object := conn.Object("org.freedesktop.systemd1", "/org/freedesktop/systemd1")
-	call := object.Call("org.freedesktop.systemd1.Manager.GetUnit", 0, unitName)
+	call := callWithContext(ctx, object, "org.freedesktop.systemd1.Manager.GetUnit", unitName)
 
 	if call.Err != nil {
 		return "", call.Err
@@ -63,19 +82,19 @@ func systemdGetUnitPath(unitName string) (dbus.ObjectPath, error) {
 	return path, nil
 }
 
-func systemdStopUnit(unitName string) error {
+func systemdStopUnit(ctx context.Context, unitName string) error {
 	conn, err := dbus.SystemBus()
 	if err != nil {
 		return fmt.Errorf("Failed to connect to session bus: %s", err.Error())
 	}
 
-	unitPath, err := systemdGetUnitPath(unitName)
+	unitPath, err := systemdGetUnitPath(ctx, unitName)
 	if err != nil {
 		return err
 	}
 
 	object := conn.Object("org.freedesktop.systemd1", unitPath)
-	call := object.Call("org.freedesktop.systemd1.Unit.Stop", 0, "replace")
+	call := callWithContext(ctx, object, "org.freedesktop.systemd1.Unit.Stop", "replace")
 
 	if call.Err != nil {
 		return call.Err
@@ -84,19 +103,19 @@ func systemdStopUnit(unitName string) error {
 	return nil
 }
 
-func systemdRestartUnit(unitName string) error {
+func systemdRestartUnit(ctx context.Context, unitName string) error {
 	conn, err := dbus.SystemBus()
 	if err != nil {
 		return fmt.Errorf("Failed to connect to session bus: %s", err.Error())
 	}
 
-	unitPath, err := systemdGetUnitPath(unitName)
+	unitPath, err := systemdGetUnitPath(ctx, unitName)
 	if err != nil {
 		return err
 	}
 
 	object := conn.Object("org.freedesktop.systemd1", unitPath)
-	call := object.Call("org.freedesktop.systemd1.Unit.Restart", 0, "replace")
+	call := callWithContext(ctx, object, "org.freedesktop.systemd1.Unit.Restart", "replace")
 
 	if call.Err != nil {
 		return call.Err
@@ -104,3 +123,124 @@ func systemdRestartUnit(unitName string) error {
 
 	return nil
 }
+
+func systemdGetUnitFileState(ctx context.Context, unitName string) (string, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return "", fmt.Errorf("Failed to connect to session bus: %s", err.Error())
+	}
+
+	object := conn.Object("org.freedesktop.systemd1", "/org/freedesktop/systemd1")
+	call := callWithContext(ctx, object, "org.freedesktop.systemd1.Manager.GetUnitFileState", unitName)
+
+	if call.Err != nil {
+		return "", call.Err
+	}
+
+	if len(call.Body) == 0 {
+		return "", fmt.Errorf("systemdGetUnitFileState: dbus gave an empty response")
+	}
+
+	state, ok := call.Body[0].(string)
+	if !ok {
+		return "", fmt.Errorf("systemdGetUnitFileState: dbus returned a non-string")
+	}
+
+	return state, nil
+}
+
+// systemdGetUnitProperty returns a property of a unit, which is loaded if necessary
+func systemdGetUnitProperty(ctx context.Context, unitName, iface, property string) (interface{}, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to session bus: %s", err.Error())
+	}
+
+	// LoadUnit, unlike GetUnit, also works for units which aren't loaded
+	object := conn.Object("org.freedesktop.systemd1", "/org/freedesktop/systemd1")
+	call := callWithContext(ctx, object, "org.freedesktop.systemd1.Manager.LoadUnit", unitName)
+	if call.Err != nil {
+		return nil, call.Err
+	}
+
+	if len(call.Body) == 0 {
+		return nil, fmt.Errorf("systemdGetUnitProperty: dbus gave an empty response")
+	}
+
+	unitPath, ok := call.Body[0].(dbus.ObjectPath)
+	if !ok {
+		return nil, fmt.Errorf("systemdGetUnitProperty: dbus returned a non-ObjectPath")
+	}
+
+	unitObject := conn.Object("org.freedesktop.systemd1", unitPath)
+	call = callWithContext(ctx, unitObject, "org.freedesktop.DBus.Properties.Get", iface, property)
+	if call.Err != nil {
+		return nil, call.Err
+	}
+
+	if len(call.Body) == 0 {
+		return nil, fmt.Errorf("systemdGetUnitProperty: dbus gave an empty response")
+	}
+
+	value, ok := call.Body[0].(dbus.Variant)
+	if !ok {
+		return nil, fmt.Errorf("systemdGetUnitProperty: dbus returned a non-Variant")
+	}
+
+	return value.Value(), nil
+}
+
+func systemdGetUnitActiveState(ctx context.Context, unitName string) (string, error) {
+	value, err := systemdGetUnitProperty(ctx, unitName, "org.freedesktop.systemd1.Unit", "ActiveState")
+	if err != nil {
+		return "", err
+	}
+
+	state, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("systemdGetUnitActiveState: dbus returned a non-string")
+	}
+
+	return state, nil
+}
+
+// systemdGetUnitStatus returns the state of a unit, for inactive services
+// also how they ended
+func systemdGetUnitStatus(ctx context.Context, unitName string) (unitRunState, error) {
+	var status unitRunState
+	var err error
+
+	status.ActiveState, err = systemdGetUnitActiveState(ctx, unitName)
+	if err != nil || status.ActiveState != "inactive" || !strings.HasSuffix(unitName, ".service") {
+		return status, err
+	}
+
+	value, err := systemdGetUnitProperty(ctx, unitName, "org.freedesktop.systemd1.Service", "Result")
+	if err != nil {
+		return status, err
+	}
+	status.Result, _ = value.(string)
+
+	// a service which hasn't been started yet has succeeded as well
+	value, err = systemdGetUnitProperty(ctx, unitName, "org.freedesktop.systemd1.Unit", "InactiveExitTimestampMonotonic")
+	if err != nil {
+		return status, err
+	}
+	started, _ := value.(uint64)
+	status.Started = started != 0
+
+	return status, nil
+}
+
+// systemdPing checks that systemd answers on the system bus
+func systemdPing(ctx context.Context) error {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return fmt.Errorf("failed to connect to system bus: %s", err.Error())
+	}
+
+	object := conn.Object("org.freedesktop.systemd1", "/org/freedesktop/systemd1")
+	call := callWithContext(ctx, object, "org.freedesktop.DBus.Peer.Ping")
+
+	return call.Err
+}
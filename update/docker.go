@@ -1,19 +1,19 @@
 package update
 
 import (
-	"archive/tar"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"os"
-	"path"
 	"sync"
 
 	"github.com/fsouza/go-dockerclient"
 )
 
+var dockerConfigPath = "/root/.docker/config.json"
+
 type jsonstreamMessage struct {
 	Status string `json:"status"`
 	ID     string `json:"id"`
@@ -56,39 +56,62 @@ func (jsed *jsonstreamErrorDetector) Write(p []byte) (n int, err error) {
 	return n, nil
 }
 
-func pullImage(repository, tag string, authCfg io.Reader) error {
-	var jsed jsonstreamErrorDetector
+func pullImage(ctx context.Context, repository, tag string, authCfg io.Reader) error {
+	return pullImageLimited(ctx, repository, tag, authCfg, nil)
+}
+
+// pullImageLimited pulls an image, limiting the download rate if limiter
+// is set. The rate is limited by pulling through a registry proxy, the image
+// is tagged with its real name afterwards.
+func pullImageLimited(ctx context.Context, repository, tag string, authCfg io.Reader, limiter *rateLimiter) error {
+	repository = mirroredImageName(repository)
+	// the credentials are those of the registry behind the proxy
+	auth := registryAuth(repository, authCfg)
+
+	client, err := docker.NewClientFromEnv()
+	if err != nil {
+		return err
+	}
+
+	pullRepository := repository
+	if limiter != nil {
+		upstream, name := proxiedRepository(repository)
+		proxy, err := startRegistryProxy(upstream, limiter, newRegistryProxyClient())
+		if err != nil {
+			return err
+		}
+		defer proxy.Close()
+		pullRepository = proxy.Host() + "/" + name
+	}
 
+	var jsed jsonstreamErrorDetector
 	opts := docker.PullImageOptions{
-		Repository:    repository,
+		Repository:    pullRepository,
 		Tag:           tag,
 		OutputStream:  &jsed,
 		RawJSONStream: true,
+		Context:       ctx,
 	}
 
-	client, err := docker.NewClientFromEnv()
+	// the full path to the config file is used if authCfg is nil,
+	// since running from a systemd unit doesn't provide $HOME
+	err = client.PullImage(opts, auth)
 	if err != nil {
 		return err
 	}
 
-	var auth *docker.AuthConfigurations
-	if authCfg == nil {
-		// the full path to the config file is provided,
-		// since running from a systemd unit doesn't provide $HOME
-		auth, err = docker.NewAuthConfigurationsFromFile("/root/.docker/config.json")
-	} else {
-		auth, err = docker.NewAuthConfigurations(authCfg)
-	}
-	if err != nil {
-		return err
+	if pullRepository == repository {
+		return nil
 	}
 
-	err = client.PullImage(opts, auth.Configs["quay.io"])
+	proxiedName := fmt.Sprintf("%s:%s", pullRepository, tag)
+	err = client.TagImage(proxiedName, docker.TagImageOptions{Repo: repository, Tag: tag, Force: true, Context: ctx})
 	if err != nil {
-		return err
+		return fmt.Errorf("pullImageLimited: tagging '%s': %s", proxiedName, err.Error())
 	}
 
-	return nil
+	// the port of the proxy changes, so its tag is of no use anymore
+	return client.RemoveImageExtended(proxiedName, docker.RemoveImageOptions{NoPrune: true})
 }
 
 // exportDockerImage writes a TAR archive of a given Docker image's rootfs
@@ -96,7 +119,7 @@ func pullImage(repository, tag string, authCfg io.Reader) error {
 //
 // If returned error is not nil then the final state of the output writer
 // is not defined, i.e. the data might have been written partially.
-func exportDockerImage(repository, tag string, output io.Writer) error {
+func exportDockerImage(ctx context.Context, repository, tag string, output io.Writer) error {
 	c, err := docker.NewClientFromEnv()
 	if err != nil {
 		return err
@@ -104,27 +127,40 @@ func exportDockerImage(repository, tag string, output io.Writer) error {
 
 	createContainerOpts := docker.CreateContainerOptions{
 		Config: &docker.Config{
-			Image: fmt.Sprintf("%s:%s", repository, tag),
+			Image:  fmt.Sprintf("%s:%s", mirroredImageName(repository), tag),
+			Labels: map[string]string{exportLabel: "true"},
 		},
+		Context: ctx,
 	}
 
 	containter, err := c.CreateContainer(createContainerOpts)
 	if err != nil {
 		return err
 	}
+	// no context here, the container has to be removed even if the export has been cancelled
 	defer c.RemoveContainer(docker.RemoveContainerOptions{ID: containter.ID, RemoveVolumes: true, Force: true})
 
 	exportContainerOptions := docker.ExportContainerOptions{
 		ID:           containter.ID,
 		OutputStream: output,
+		Context:      ctx,
 	}
 
 	return c.ExportContainer(exportContainerOptions)
 }
 
 // extractDockerImage writes a given image's rootfs to the target folder,
-// ignoring everything that isn't a regular file or directory
-func extractDockerImage(repository, tag, extractDir string) error {
+// see extractTar. Depending on extractMethod the image is either exported
+// from a temporary container or flattened from the saved image.
+func extractDockerImage(ctx context.Context, repository, tag, extractDir string) error {
+	switch extractMethod {
+	case extractMethodExport:
+	case extractMethodSave:
+		return extractSavedDockerImage(ctx, repository, tag, extractDir)
+	default:
+		return fmt.Errorf("extractDockerImage: unknown extract method '%s'", extractMethod)
+	}
+
 	// this pipe connects exportDockerImage to the tar reader
 	pipeReader, pipeWriter := io.Pipe()
 
@@ -133,56 +169,47 @@ func extractDockerImage(repository, tag, extractDir string) error {
 	wg.Add(1)
 	var extractErr error
 	go func() {
-		extractErr = exportDockerImage(repository, tag, pipeWriter)
+		extractErr = exportDockerImage(ctx, repository, tag, pipeWriter)
 		// need to close this end or the other end will block
 		pipeWriter.Close()
 		wg.Done()
 	}()
 
-	// wrap a TAR reader around the other and extract
-	tarReader := tar.NewReader(pipeReader)
-	for {
-		header, nextErr := tarReader.Next()
-		if nextErr != nil {
-			if nextErr == io.EOF {
-				break
-			}
-			return nextErr
-		}
-
-		switch header.Typeflag {
-		case tar.TypeDir:
-			mkdirErr := os.MkdirAll(path.Join(extractDir, header.Name), 0755)
-			if mkdirErr != nil {
-				return mkdirErr
-			}
-			io.CopyN(ioutil.Discard, tarReader, header.Size)
-		case tar.TypeReg:
-			f, err := os.OpenFile(path.Join(extractDir, header.Name), os.O_CREATE|os.O_WRONLY, 0644)
-			if err != nil {
-				return err
-			}
-			_, err = io.CopyN(f, tarReader, header.Size)
-			if err != nil {
-				return err
-			}
-			f.Close()
-		case tar.TypeSymlink:
-			linkErr := os.Symlink(header.Linkname, path.Join(extractDir, header.Name))
-			if linkErr != nil {
-				return linkErr
-			}
-		default:
-			// ignore
-			io.CopyN(ioutil.Discard, tarReader, header.Size)
-		}
+	err := extractTar(pipeReader, extractDir)
+	if err == nil {
+		// consume the padding after the end of the archive
+		io.Copy(ioutil.Discard, pipeReader)
+	} else {
+		// unblock the export, it can't finish anymore
+		pipeReader.CloseWithError(err)
 	}
-
 	wg.Wait()
 
+	if err != nil {
+		return err
+	}
+
 	if extractErr != nil {
 		return extractErr
 	}
 
 	return nil
 }
+
+// imageExists checks whether the given image is present in the local Docker daemon
+func imageExists(repository, tag string) (bool, error) {
+	client, err := docker.NewClientFromEnv()
+	if err != nil {
+		return false, err
+	}
+
+	_, err = client.InspectImage(fmt.Sprintf("%s:%s", mirroredImageName(repository), tag))
+	if err == docker.ErrNoSuchImage {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -72,17 +73,17 @@ func TestPullImage(t *testing.T) {
 
 	// pull is OK
 	testAuth.Seek(0, io.SeekStart)
-	err := pullImage(testImageRepo, "v1", testAuth)
+	err := pullImage(context.Background(), testImageRepo, "v1", testAuth)
 	assert.Nil(t, err)
 
 	// pull errored
 	testAuth.Seek(0, io.SeekStart)
-	err = pullImage(testImageRepo, "v2", testAuth)
+	err = pullImage(context.Background(), testImageRepo, "v2", testAuth)
 	assert.EqualError(t, err, "Docker error: something bad happened")
 
 	// msg stream is cut off
 	testAuth.Seek(0, io.SeekStart)
-	err = pullImage(testImageRepo, "v3", testAuth)
+	err = pullImage(context.Background(), testImageRepo, "v3", testAuth)
 	assert.Equal(t, err, io.ErrUnexpectedEOF)
 }
 
@@ -140,7 +141,7 @@ func TestExportDockerImage(t *testing.T) {
 
 	// direct export to buffer
 	imageBuf := bytes.NewBuffer([]byte{})
-	err = exportDockerImage("repository", "tag", imageBuf)
+	err = exportDockerImage(context.Background(), "repository", "tag", imageBuf)
 	assert.Nil(t, err)
 	assert.EqualValues(t, testTARBuffer.Bytes(), imageBuf.Bytes())
 
@@ -152,7 +153,7 @@ func TestExportDockerImage(t *testing.T) {
 	wg.Add(1)
 	var extractErr error
 	go func() {
-		extractErr = exportDockerImage("repository", "tag", bufio.NewWriter(pipeWriter))
+		extractErr = exportDockerImage(context.Background(), "repository", "tag", bufio.NewWriter(pipeWriter))
 		// needs to be closed, or io.Copy from the other end will be stuck forever
 		pipeWriter.Close()
 		wg.Done()
@@ -160,6 +161,7 @@ func TestExportDockerImage(t *testing.T) {
 
 	io.Copy(bufio.NewWriter(imageBuf2), bufio.NewReader(pipeReader))
 	wg.Wait()
+	assert.Nil(t, extractErr)
 }
 
 func TestExtractDockerImage(t *testing.T) {
@@ -216,7 +218,7 @@ func TestExtractDockerImage(t *testing.T) {
 	assert.Nil(t, err)
 	defer os.RemoveAll(tempDir)
 
-	err = extractDockerImage("repository", "tag", tempDir)
+	err = extractDockerImage(context.Background(), "repository", "tag", tempDir)
 	assert.Nil(t, err)
 
 	rootInfo, err := ioutil.ReadDir(tempDir)
@@ -0,0 +1,62 @@
+package update
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/experimental-platform/platconf/platconf"
+)
+
+// doctorManifestTimeout limits fetching the manifest the pull size is estimated from
+const doctorManifestTimeout = 2 * time.Minute
+
+// DoctorOpts contains command line parameters for the 'doctor' command
+type DoctorOpts struct {
+	Channel string `short:"c" long:"channel" description:"Channel whose latest release the disk space is checked for"`
+	JSON    bool   `long:"json" description:"Print the results as JSON"`
+
+	Config *platconf.Config `no-flag:"true"`
+}
+
+// Execute is the function ran when the 'doctor' command is used
+func (o *DoctorOpts) Execute(args []string) error {
+	os.Setenv("DOCKER_API_VERSION", "1.22")
+	applyConfig(o.Config)
+
+	channel, _ := getChannel(o.Channel)
+	manifestResult := preflightResult{Check: "release manifest"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), doctorManifestTimeout)
+	manifest, err := fetchReleaseData(ctx, channel)
+	cancel()
+	if err != nil {
+		manifestResult.Message = fmt.Sprintf("channel '%s': %s", channel, err.Error())
+	} else {
+		manifestResult.OK = true
+		manifestResult.Message = fmt.Sprintf("channel '%s', build %d", channel, manifest.Build)
+	}
+
+	results := append([]preflightResult{manifestResult}, runPreflightChecks(context.Background(), "/", manifest, 0)...)
+
+	if o.JSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(results)
+		if err != nil {
+			return err
+		}
+	} else {
+		printPreflightResults(os.Stdout, results)
+	}
+
+	for _, r := range results {
+		if !r.OK {
+			os.Exit(1)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,262 @@
+package update
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// parseDownloadRate parses a rate in bytes per second with an optional
+// 'K', 'M' or 'G' suffix (powers of 1024). An empty string or 0 means
+// no limit.
+func parseDownloadRate(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		s = s[:len(s)-1]
+	}
+
+	rate, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || rate < 0 {
+		return 0, fmt.Errorf("parseDownloadRate: '%s' is not a valid rate", s)
+	}
+
+	return rate * multiplier, nil
+}
+
+// rateLimiter spreads a byte budget over time, it's shared by all pullers
+type rateLimiter struct {
+	rate int64 // bytes per second
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	return &rateLimiter{rate: rate}
+}
+
+// wait accounts for n transferred bytes and blocks until the limiter
+// allows further transfers
+func (l *rateLimiter) wait(ctx context.Context, n int64) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / float64(l.rate) * float64(time.Second)))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// downloadWindow is a daily time span in local time, it may span midnight
+type downloadWindow struct {
+	start time.Duration // offset from midnight
+	end   time.Duration
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// parseDownloadWindow parses a window like '22:00-06:00', an empty string
+// means downloads may run at any time
+func parseDownloadWindow(s string) (*downloadWindow, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("parseDownloadWindow: '%s' is not of the form 'HH:MM-HH:MM'", s)
+	}
+
+	start, err := parseTimeOfDay(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("parseDownloadWindow: '%s' is not of the form 'HH:MM-HH:MM'", s)
+	}
+
+	end, err := parseTimeOfDay(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("parseDownloadWindow: '%s' is not of the form 'HH:MM-HH:MM'", s)
+	}
+
+	if start == end {
+		return nil, fmt.Errorf("parseDownloadWindow: the window '%s' is empty", s)
+	}
+
+	return &downloadWindow{start: start, end: end}, nil
+}
+
+func timeOfDay(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+}
+
+func (w *downloadWindow) contains(t time.Time) bool {
+	offset := timeOfDay(t)
+	if w.start < w.end {
+		return offset >= w.start && offset < w.end
+	}
+
+	return offset >= w.start || offset < w.end
+}
+
+// untilOpen returns how long it takes until the window opens, 0 if it is open
+func (w *downloadWindow) untilOpen(t time.Time) time.Duration {
+	if w.contains(t) {
+		return 0
+	}
+
+	d := w.start - timeOfDay(t)
+	if d < 0 {
+		d += 24 * time.Hour
+	}
+
+	return d
+}
+
+// untilClose returns how long the window stays open
+func (w *downloadWindow) untilClose(t time.Time) time.Duration {
+	d := w.end - timeOfDay(t)
+	if d <= 0 {
+		d += 24 * time.Hour
+	}
+
+	return d
+}
+
+func (w *downloadWindow) String() string {
+	format := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+	}
+
+	return format(w.start) + "-" + format(w.end)
+}
+
+// downloadSchedule holds the limits applied to image pulls, a nil
+// schedule doesn't limit anything
+type downloadSchedule struct {
+	limiter *rateLimiter
+	window  *downloadWindow
+
+	mu      sync.Mutex
+	waiting int
+}
+
+func newDownloadSchedule(rate, window string) (*downloadSchedule, error) {
+	bytesPerSecond, err := parseDownloadRate(rate)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := parseDownloadWindow(window)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytesPerSecond == 0 && w == nil {
+		return nil, nil
+	}
+
+	return &downloadSchedule{limiter: newRateLimiter(bytesPerSecond), window: w}, nil
+}
+
+// waitForWindow blocks until downloads are allowed. The first puller to
+// wait reports it to the status server, the last one to resume reports
+// that the downloads go on.
+func (s *downloadSchedule) waitForWindow(ctx context.Context) error {
+	if s == nil || s.window == nil {
+		return nil
+	}
+
+	delay := s.window.untilOpen(time.Now())
+	if delay == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	s.waiting++
+	if s.waiting == 1 {
+		log.Printf("Outside of the download window %s, waiting %s\n", s.window, delay)
+		setStatus("waiting for download window", nil, nil)
+	}
+	s.mu.Unlock()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	s.mu.Lock()
+	s.waiting--
+	if s.waiting == 0 && err == nil {
+		log.Println("Download window opened, resuming the downloads")
+		setStatus("downloading", nil, nil)
+	}
+	s.mu.Unlock()
+
+	return err
+}
+
+// pullContext returns the context for a single pull, which is cancelled
+// when the download window closes
+func (s *downloadSchedule) pullContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s == nil || s.window == nil {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, s.window.untilClose(time.Now()))
+}
+
+// pullLimiter returns the limiter for the pulls, nil if there's no limit
+func (s *downloadSchedule) pullLimiter() *rateLimiter {
+	if s == nil {
+		return nil
+	}
+
+	return s.limiter
+}
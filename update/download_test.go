@@ -0,0 +1,84 @@
+package update
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDownloadRate(t *testing.T) {
+	rates := map[string]int64{
+		"":     0,
+		"0":    0,
+		"1000": 1000,
+		"500K": 500 * 1024,
+		"2m":   2 * 1024 * 1024,
+		"1G":   1024 * 1024 * 1024,
+	}
+	for s, expected := range rates {
+		rate, err := parseDownloadRate(s)
+		assert.Nil(t, err, s)
+		assert.Equal(t, expected, rate, s)
+	}
+
+	for _, s := range []string{"fast", "-1", "2T", "K"} {
+		_, err := parseDownloadRate(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestDownloadWindow(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2017, 3, 1, hour, minute, 0, 0, time.Local)
+	}
+
+	w, err := parseDownloadWindow("09:00-17:30")
+	assert.Nil(t, err)
+	assert.Equal(t, "09:00-17:30", w.String())
+	assert.False(t, w.contains(at(8, 59)))
+	assert.True(t, w.contains(at(9, 0)))
+	assert.True(t, w.contains(at(17, 29)))
+	assert.False(t, w.contains(at(17, 30)))
+	assert.Equal(t, time.Duration(0), w.untilOpen(at(12, 0)))
+	assert.Equal(t, 30*time.Minute, w.untilOpen(at(8, 30)))
+	assert.Equal(t, 15*time.Hour+30*time.Minute, w.untilOpen(at(17, 30)))
+	assert.Equal(t, 5*time.Hour+30*time.Minute, w.untilClose(at(12, 0)))
+
+	// spanning midnight
+	w, err = parseDownloadWindow("22:00-06:00")
+	assert.Nil(t, err)
+	assert.True(t, w.contains(at(23, 0)))
+	assert.True(t, w.contains(at(3, 0)))
+	assert.False(t, w.contains(at(12, 0)))
+	assert.Equal(t, 10*time.Hour, w.untilOpen(at(12, 0)))
+	assert.Equal(t, 7*time.Hour, w.untilClose(at(23, 0)))
+	assert.Equal(t, 3*time.Hour, w.untilClose(at(3, 0)))
+
+	w, err = parseDownloadWindow("")
+	assert.Nil(t, err)
+	assert.Nil(t, w)
+
+	for _, s := range []string{"22:00", "25:00-06:00", "06:00-06:00", "night"} {
+		_, err = parseDownloadWindow(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	assert.Nil(t, newRateLimiter(0))
+
+	limiter := newRateLimiter(1000)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, limiter.wait(context.Background(), 100))
+	}
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 250*time.Millisecond, elapsed.String())
+	assert.True(t, elapsed < 2*time.Second, elapsed.String())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.NotNil(t, limiter.wait(ctx, 1000000))
+}
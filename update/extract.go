@@ -0,0 +1,295 @@
+package update
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// extractedMode returns the permission bits of a tar entry, including the
+// setuid, setgid and sticky bits
+func extractedMode(header *tar.Header) os.FileMode {
+	return header.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+}
+
+// applyMetadata sets the ownership, mode, mtime and extended attributes
+// of an extracted file. Ownership is only restored when running as root.
+func applyMetadata(target string, header *tar.Header) error {
+	if os.Geteuid() == 0 {
+		err := os.Lchown(target, header.Uid, header.Gid)
+		if err != nil {
+			return err
+		}
+	}
+
+	// symlinks don't have their own permissions, and changing the mtime
+	// or the attributes would affect their target
+	if header.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+
+	// chown clears the setuid bits, so the mode comes after it
+	err := os.Chmod(target, extractedMode(header))
+	if err != nil {
+		return err
+	}
+
+	for name, value := range header.Xattrs {
+		err = setXattr(target, name, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	if header.Typeflag == tar.TypeDir {
+		// the mtime of directories is set once all their contents are in place
+		return nil
+	}
+
+	return os.Chtimes(target, header.ModTime, header.ModTime)
+}
+
+// entryPath returns the path of an archive entry inside extractDir. Names
+// containing '..' are rejected, as are entries which would be created
+// inside a symlink extracted earlier. Unless the entry may replace existing
+// files, it may not take the place of a symlink either.
+func entryPath(extractDir, name string, replace bool) (string, error) {
+	if path.IsAbs(name) {
+		return "", fmt.Errorf("absolute path")
+	}
+
+	for _, component := range strings.Split(name, "/") {
+		if component == ".." {
+			return "", fmt.Errorf("path contains '..'")
+		}
+	}
+
+	cleaned := path.Clean(name)
+	if cleaned == "." {
+		return extractDir, nil
+	}
+
+	current := extractDir
+	components := strings.Split(cleaned, "/")
+	for i, component := range components {
+		current = path.Join(current, component)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink != 0 && !(replace && i == len(components)-1) {
+			return "", fmt.Errorf("'%s' is a symlink", strings.TrimPrefix(current, extractDir+"/"))
+		}
+	}
+
+	return path.Join(extractDir, cleaned), nil
+}
+
+// symlinkTarget checks that a symlink stays inside the extracted tree.
+// Absolute targets refer to the root of the image, they are turned
+// into relative ones so they don't point into the host filesystem.
+func symlinkTarget(name, linkname string) (string, error) {
+	linkDir := path.Dir(path.Join("/", name))
+
+	if path.IsAbs(linkname) {
+		return filepath.Rel(linkDir, path.Clean(linkname))
+	}
+
+	depth := len(strings.Split(linkDir, "/")) - 1
+	if linkDir == "/" {
+		depth = 0
+	}
+
+	for _, component := range strings.Split(linkname, "/") {
+		switch component {
+		case "", ".":
+		case "..":
+			depth--
+			if depth < 0 {
+				return "", fmt.Errorf("symlink target '%s' escapes the root", linkname)
+			}
+		default:
+			depth++
+		}
+	}
+
+	return linkname, nil
+}
+
+// checkSymlinks makes sure that none of the extracted symlinks resolves
+// to a path outside of extractDir, even when following other symlinks
+func checkSymlinks(extractDir string, links []string) ([]string, error) {
+	root, err := filepath.EvalSymlinks(extractDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var offending []string
+	for _, link := range links {
+		resolved, err := filepath.EvalSymlinks(link)
+		if os.IsNotExist(err) {
+			// dangling links have been checked when they were created
+			continue
+		}
+		if err != nil || (resolved != root && !strings.HasPrefix(resolved, root+"/")) {
+			offending = append(offending, strings.TrimPrefix(link, extractDir+"/"))
+		}
+	}
+
+	return offending, nil
+}
+
+// extractTar writes the contents of a tar stream to the target directory,
+// keeping the mode, ownership, mtime and extended attributes of the entries.
+// Directories, regular files, symlinks and hardlinks are supported,
+// everything else is skipped.
+//
+// Entries which would end up outside of extractDir are skipped and reported
+// in the returned error once the whole archive has been read.
+func extractTar(r io.Reader, extractDir string) error {
+	return extractTarEntries(r, extractDir, false)
+}
+
+// removeExisting makes room for an entry of a layer which replaces a file
+// of a lower layer. Directories are kept if the entry is a directory too.
+func removeExisting(target string, header *tar.Header) error {
+	info, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() && header.Typeflag == tar.TypeDir {
+		return nil
+	}
+
+	return os.RemoveAll(target)
+}
+
+// extractTarEntries implements extractTar. With overlay, entries replace
+// existing files as needed when the archive is an image layer extracted on
+// top of the lower ones, and whiteout files are skipped.
+func extractTarEntries(r io.Reader, extractDir string, overlay bool) error {
+	type dirTime struct {
+		path  string
+		mtime time.Time
+	}
+	var dirTimes []dirTime
+	var links []string
+	var rejected []string
+
+	reject := func(name string, reason error) {
+		log.Printf("extractTar: rejecting '%s': %s\n", name, reason.Error())
+		rejected = append(rejected, fmt.Sprintf("'%s' (%s)", name, reason.Error()))
+	}
+
+	tarReader := tar.NewReader(r)
+	for {
+		header, err := tarReader.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+
+		if overlay && strings.HasPrefix(path.Base(header.Name), whiteoutPrefix) {
+			continue
+		}
+
+		target, err := entryPath(extractDir, header.Name, overlay)
+		if err != nil {
+			reject(header.Name, err)
+			continue
+		}
+
+		if overlay && target != extractDir {
+			err = removeExisting(target, header)
+			if err != nil {
+				return err
+			}
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+			if err != nil {
+				return err
+			}
+			dirTimes = append(dirTimes, dirTime{target, header.ModTime})
+		case tar.TypeReg, tar.TypeRegA:
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+			if err != nil {
+				return err
+			}
+			_, err = io.CopyN(f, tarReader, header.Size)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			linkname, err := symlinkTarget(header.Name, header.Linkname)
+			if err != nil {
+				reject(header.Name, err)
+				continue
+			}
+			err = os.Symlink(linkname, target)
+			if err != nil {
+				return err
+			}
+			links = append(links, target)
+		case tar.TypeLink:
+			source, err := entryPath(extractDir, header.Linkname, false)
+			if err != nil {
+				reject(header.Name, fmt.Errorf("hardlink target: %s", err.Error()))
+				continue
+			}
+			err = os.Link(source, target)
+			if err != nil {
+				return err
+			}
+			// the link shares the metadata of the file it points to
+			continue
+		default:
+			log.Printf("extractTar: skipping '%s' of type %c\n", header.Name, header.Typeflag)
+			continue
+		}
+
+		err = applyMetadata(target, header)
+		if err != nil {
+			return err
+		}
+	}
+
+	offending, err := checkSymlinks(extractDir, links)
+	if err != nil {
+		return err
+	}
+	for _, link := range offending {
+		reject(link, fmt.Errorf("symlink resolves outside of the root"))
+	}
+
+	if len(rejected) > 0 {
+		return fmt.Errorf("extractTar: the archive contains unsafe entries: %s", strings.Join(rejected, ", "))
+	}
+
+	for i := len(dirTimes) - 1; i >= 0; i-- {
+		err := os.Chtimes(dirTimes[i].path, dirTimes[i].mtime, dirTimes[i].mtime)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
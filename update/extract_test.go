@@ -0,0 +1,173 @@
+package update
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testTarEntry struct {
+	header tar.Header
+	body   string
+}
+
+func makeTestTar(t *testing.T, entries []testTarEntry) *bytes.Buffer {
+	buf := bytes.NewBuffer([]byte{})
+	w := tar.NewWriter(buf)
+	for _, e := range entries {
+		e.header.Size = int64(len(e.body))
+		assert.Nil(t, w.WriteHeader(&e.header))
+		_, err := w.Write([]byte(e.body))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, w.Close())
+	return buf
+}
+
+func TestExtractTarMetadata(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "platconf-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	mtime := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	archive := makeTestTar(t, []testTarEntry{
+		{header: tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0750, ModTime: mtime, Uid: 1234, Gid: 2345}},
+		{header: tar.Header{Name: "bin/tool", Typeflag: tar.TypeReg, Mode: 04711, ModTime: mtime, Uid: 1234, Gid: 2345}, body: "#!/bin/sh"},
+		{header: tar.Header{Name: "bin/config", Typeflag: tar.TypeReg, Mode: 0600, ModTime: mtime}, body: "foo=bar"},
+		{header: tar.Header{Name: "bin/tool-link", Typeflag: tar.TypeLink, Linkname: "bin/tool"}},
+		{header: tar.Header{Name: "bin/tool-symlink", Typeflag: tar.TypeSymlink, Linkname: "tool", ModTime: mtime}},
+		{header: tar.Header{Name: "fifo", Typeflag: tar.TypeFifo, Mode: 0644}},
+	})
+
+	err = extractTar(archive, tempDir)
+	assert.Nil(t, err)
+
+	info, err := os.Stat(path.Join(tempDir, "bin"))
+	assert.Nil(t, err)
+	assert.True(t, info.IsDir())
+	assert.Equal(t, os.FileMode(0750), info.Mode().Perm())
+	assert.True(t, mtime.Equal(info.ModTime()))
+
+	info, err = os.Stat(path.Join(tempDir, "bin/tool"))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0711)|os.ModeSetuid, info.Mode())
+	assert.True(t, mtime.Equal(info.ModTime()))
+	if os.Geteuid() == 0 {
+		stat := info.Sys().(*syscall.Stat_t)
+		assert.Equal(t, uint32(1234), stat.Uid)
+		assert.Equal(t, uint32(2345), stat.Gid)
+	}
+
+	info, err = os.Stat(path.Join(tempDir, "bin/config"))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode())
+
+	linkInfo, err := os.Stat(path.Join(tempDir, "bin/tool-link"))
+	assert.Nil(t, err)
+	toolInfo, err := os.Stat(path.Join(tempDir, "bin/tool"))
+	assert.Nil(t, err)
+	assert.True(t, os.SameFile(toolInfo, linkInfo))
+
+	target, err := os.Readlink(path.Join(tempDir, "bin/tool-symlink"))
+	assert.Nil(t, err)
+	assert.Equal(t, "tool", target)
+
+	_, err = os.Lstat(path.Join(tempDir, "fifo"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestExtractTarTraversal(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []testTarEntry
+	}{
+		{"dotdot", []testTarEntry{
+			{header: tar.Header{Name: "../escaped", Typeflag: tar.TypeReg, Mode: 0644}, body: "foo"},
+		}},
+		{"nested dotdot", []testTarEntry{
+			{header: tar.Header{Name: "a/", Typeflag: tar.TypeDir, Mode: 0755}},
+			{header: tar.Header{Name: "a/../../escaped", Typeflag: tar.TypeReg, Mode: 0644}, body: "foo"},
+		}},
+		{"absolute", []testTarEntry{
+			{header: tar.Header{Name: "/escaped", Typeflag: tar.TypeReg, Mode: 0644}, body: "foo"},
+		}},
+		{"relative symlink", []testTarEntry{
+			{header: tar.Header{Name: "a/", Typeflag: tar.TypeDir, Mode: 0755}},
+			{header: tar.Header{Name: "a/link", Typeflag: tar.TypeSymlink, Linkname: "../../escaped"}},
+		}},
+		{"write through symlink", []testTarEntry{
+			{header: tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "."}},
+			{header: tar.Header{Name: "link/file", Typeflag: tar.TypeReg, Mode: 0644}, body: "foo"},
+		}},
+		{"replace symlink", []testTarEntry{
+			{header: tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "file"}},
+			{header: tar.Header{Name: "link", Typeflag: tar.TypeReg, Mode: 0644}, body: "foo"},
+		}},
+		{"hardlink", []testTarEntry{
+			{header: tar.Header{Name: "link", Typeflag: tar.TypeLink, Linkname: "../escaped"}},
+		}},
+		{"symlink chain", []testTarEntry{
+			{header: tar.Header{Name: "a/", Typeflag: tar.TypeDir, Mode: 0755}},
+			{header: tar.Header{Name: "a/up", Typeflag: tar.TypeSymlink, Linkname: ".."}},
+			{header: tar.Header{Name: "a/link", Typeflag: tar.TypeSymlink, Linkname: "up/../escaped"}},
+		}},
+	}
+
+	for _, test := range tests {
+		parentDir, err := ioutil.TempDir("", "platconf-test")
+		assert.Nil(t, err)
+		defer os.RemoveAll(parentDir)
+
+		// the outside file exists, so links to it can be resolved
+		err = ioutil.WriteFile(path.Join(parentDir, "escaped"), []byte("outside"), 0644)
+		assert.Nil(t, err)
+
+		extractDir := path.Join(parentDir, "root")
+		assert.Nil(t, os.Mkdir(extractDir, 0755))
+
+		err = extractTar(makeTestTar(t, test.entries), extractDir)
+		assert.NotNil(t, err, test.name)
+
+		data, err := ioutil.ReadFile(path.Join(parentDir, "escaped"))
+		assert.Nil(t, err, test.name)
+		assert.Equal(t, "outside", string(data), test.name)
+	}
+}
+
+func TestExtractTarSafeLinks(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "platconf-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	archive := makeTestTar(t, []testTarEntry{
+		{header: tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "bin/busybox", Typeflag: tar.TypeReg, Mode: 0755}, body: "foo"},
+		{header: tar.Header{Name: "bin/ls", Typeflag: tar.TypeSymlink, Linkname: "/bin/busybox"}},
+		{header: tar.Header{Name: "bin/sh", Typeflag: tar.TypeSymlink, Linkname: "../bin/./busybox"}},
+		{header: tar.Header{Name: "bin/root", Typeflag: tar.TypeSymlink, Linkname: "/"}},
+	})
+
+	err = extractTar(archive, tempDir)
+	assert.Nil(t, err)
+
+	// absolute links are relative to the extracted root
+	target, err := os.Readlink(path.Join(tempDir, "bin/ls"))
+	assert.Nil(t, err)
+	assert.Equal(t, "busybox", target)
+
+	target, err = os.Readlink(path.Join(tempDir, "bin/sh"))
+	assert.Nil(t, err)
+	assert.Equal(t, "../bin/./busybox", target)
+
+	target, err = os.Readlink(path.Join(tempDir, "bin/root"))
+	assert.Nil(t, err)
+	assert.Equal(t, "..", target)
+}
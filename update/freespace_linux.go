@@ -0,0 +1,18 @@
+//go:build linux
+// +build linux
+
+package update
+
+import "syscall"
+
+// freeSpace returns the bytes available to unprivileged users on the
+// filesystem containing path
+func freeSpace(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package update
+
+import "errors"
+
+// freeSpace isn't implemented outside of Linux
+func freeSpace(path string) (int64, error) {
+	return 0, errors.New("checking the free space is only supported on Linux")
+}
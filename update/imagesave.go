@@ -0,0 +1,265 @@
+package update
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+const (
+	// whiteoutPrefix marks files deleted in a layer
+	whiteoutPrefix = ".wh."
+	// whiteoutOpaque marks directories whose lower contents are hidden
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// the ways of getting the contents of an image, see extractDockerImage
+const (
+	extractMethodExport = "export"
+	extractMethodSave   = "save"
+)
+
+var extractMethod = extractMethodExport
+
+// savedImageManifest is an entry of the manifest.json written by 'docker save'
+type savedImageManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// saveDockerImage writes the 'docker save' archive of an image
+func saveDockerImage(ctx context.Context, repository, tag string, output io.Writer) error {
+	c, err := docker.NewClientFromEnv()
+	if err != nil {
+		return err
+	}
+
+	return c.ExportImage(docker.ExportImageOptions{
+		Name:         fmt.Sprintf("%s:%s", mirroredImageName(repository), tag),
+		OutputStream: output,
+		Context:      ctx,
+	})
+}
+
+// saveCanonicalDockerImage writes the 'docker save' archive of an image
+// tagged with its name in the manifest, even if it has been pulled from the
+// registry mirror, so the archive can be loaded on hosts without the mirror
+func saveCanonicalDockerImage(ctx context.Context, repository, tag string, output io.Writer) error {
+	c, err := docker.NewClientFromEnv()
+	if err != nil {
+		return err
+	}
+
+	canonical := fmt.Sprintf("%s:%s", repository, tag)
+	if mirrored := mirroredImageName(repository); mirrored != repository {
+		_, err = c.InspectImage(canonical)
+		if err == docker.ErrNoSuchImage {
+			err = c.TagImage(fmt.Sprintf("%s:%s", mirrored, tag), docker.TagImageOptions{Repo: repository, Tag: tag, Context: ctx})
+			if err != nil {
+				return err
+			}
+			// only the temporary tag is removed, the image is kept by the mirrored one
+			defer c.RemoveImageExtended(canonical, docker.RemoveImageOptions{NoPrune: true})
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return c.ExportImage(docker.ExportImageOptions{
+		Name:         canonical,
+		OutputStream: output,
+		Context:      ctx,
+	})
+}
+
+// extractSavedDockerImage writes an image's rootfs to the target folder by
+// flattening the layers of its saved archive, without creating a container
+func extractSavedDockerImage(ctx context.Context, repository, tag, extractDir string) error {
+	pipeReader, pipeWriter := io.Pipe()
+
+	go func() {
+		err := saveDockerImage(ctx, repository, tag, pipeWriter)
+		pipeWriter.CloseWithError(err)
+	}()
+
+	err := extractSavedImage(pipeReader, extractDir)
+	pipeReader.CloseWithError(io.ErrClosedPipe)
+	return err
+}
+
+// extractSavedImage flattens the layers of a 'docker save' archive into
+// extractDir. The archive is unpacked to a temporary directory first, as
+// the layers can appear in any order.
+func extractSavedImage(r io.Reader, extractDir string) error {
+	spoolDir, err := ioutil.TempDir("", "platconf_save_")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(spoolDir)
+
+	err = extractTar(r, spoolDir)
+	if err != nil {
+		return fmt.Errorf("extractSavedImage: %s", err.Error())
+	}
+
+	data, err := ioutil.ReadFile(path.Join(spoolDir, "manifest.json"))
+	if err != nil {
+		return fmt.Errorf("extractSavedImage: reading the manifest: %s", err.Error())
+	}
+
+	var manifests []savedImageManifest
+	err = json.Unmarshal(data, &manifests)
+	if err != nil {
+		return fmt.Errorf("extractSavedImage: parsing the manifest: %s", err.Error())
+	}
+
+	if len(manifests) != 1 {
+		return fmt.Errorf("extractSavedImage: expected a single image in the archive, got %d", len(manifests))
+	}
+
+	for _, layer := range manifests[0].Layers {
+		layerPath, err := entryPath(spoolDir, layer, true)
+		if err != nil {
+			return fmt.Errorf("extractSavedImage: layer '%s': %s", layer, err.Error())
+		}
+
+		err = applyLayer(layerPath, extractDir)
+		if err != nil {
+			return fmt.Errorf("extractSavedImage: layer '%s': %s", layer, err.Error())
+		}
+	}
+
+	// a later layer may have changed where the links of an earlier one lead to
+	var links []string
+	err = filepath.Walk(extractDir, func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode()&os.ModeSymlink != 0 {
+			links = append(links, p)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	offending, err := checkSymlinks(extractDir, links)
+	if err != nil {
+		return err
+	}
+	if len(offending) > 0 {
+		return fmt.Errorf("extractSavedImage: symlinks resolving outside of the root: %s", strings.Join(offending, ", "))
+	}
+
+	return nil
+}
+
+// applyWhiteouts deletes the files of the lower layers which have been
+// removed or hidden in the given layer
+func applyWhiteouts(layerPath, extractDir string) error {
+	f, err := os.Open(layerPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tarReader := tar.NewReader(f)
+	for {
+		header, err := tarReader.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		base := path.Base(header.Name)
+		if !strings.HasPrefix(base, whiteoutPrefix) {
+			continue
+		}
+
+		dir, err := entryPath(extractDir, path.Dir(header.Name), false)
+		if err != nil {
+			return fmt.Errorf("whiteout '%s': %s", header.Name, err.Error())
+		}
+
+		if base == whiteoutOpaque {
+			entries, err := ioutil.ReadDir(dir)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			for _, e := range entries {
+				err = os.RemoveAll(path.Join(dir, e.Name()))
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		name := strings.TrimPrefix(base, whiteoutPrefix)
+		if name == "" || name == "." || name == ".." {
+			return fmt.Errorf("invalid whiteout '%s'", header.Name)
+		}
+
+		err = os.RemoveAll(path.Join(dir, name))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// applyLayer extracts a layer on top of the previous ones
+func applyLayer(layerPath, extractDir string) error {
+	err := applyWhiteouts(layerPath, extractDir)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(layerPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return extractTarEntries(f, extractDir, true)
+}
+
+// exportLabel marks the containers created by exportDockerImage
+const exportLabel = "io.experimental-platform.platconf.export"
+
+// removeExportContainers removes the containers left behind by an
+// exportDockerImage which didn't finish, e.g. because platconf was killed
+func removeExportContainers() error {
+	c, err := docker.NewClientFromEnv()
+	if err != nil {
+		return err
+	}
+
+	containers, err := c.ListContainers(docker.ListContainersOptions{
+		All:     true,
+		Filters: map[string][]string{"label": {exportLabel}},
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, container := range containers {
+		log.Printf("Removing leftover export container %s\n", container.ID)
+		err = c.RemoveContainer(docker.RemoveContainerOptions{ID: container.ID, RemoveVolumes: true, Force: true})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package update
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractSavedImage(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "platconf-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	lowerLayer := makeTestTar(t, []testTarEntry{
+		{header: tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "etc/removed", Typeflag: tar.TypeReg, Mode: 0644}, body: "foo"},
+		{header: tar.Header{Name: "etc/replaced", Typeflag: tar.TypeSymlink, Linkname: "removed"}},
+		{header: tar.Header{Name: "opaque/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "opaque/hidden", Typeflag: tar.TypeReg, Mode: 0644}, body: "foo"},
+		{header: tar.Header{Name: "kept", Typeflag: tar.TypeReg, Mode: 0644}, body: "lower"},
+	})
+
+	upperLayer := makeTestTar(t, []testTarEntry{
+		{header: tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "etc/.wh.removed", Typeflag: tar.TypeReg, Mode: 0644}},
+		{header: tar.Header{Name: "etc/replaced", Typeflag: tar.TypeReg, Mode: 0600}, body: "upper"},
+		{header: tar.Header{Name: "opaque/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "opaque/new", Typeflag: tar.TypeReg, Mode: 0644}, body: "upper"},
+		{header: tar.Header{Name: "opaque/.wh..wh..opq", Typeflag: tar.TypeReg, Mode: 0644}},
+	})
+
+	// the upper layer comes first in the archive, the manifest defines the order
+	saved := makeTestTar(t, []testTarEntry{
+		{header: tar.Header{Name: "upper/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "upper/layer.tar", Typeflag: tar.TypeReg, Mode: 0644}, body: upperLayer.String()},
+		{header: tar.Header{Name: "lower/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "lower/layer.tar", Typeflag: tar.TypeReg, Mode: 0644}, body: lowerLayer.String()},
+		{header: tar.Header{Name: "manifest.json", Typeflag: tar.TypeReg, Mode: 0644}, body: `[{"Config":"config.json","RepoTags":["foo:bar"],"Layers":["lower/layer.tar","upper/layer.tar"]}]`},
+	})
+
+	err = extractSavedImage(saved, tempDir)
+	assert.Nil(t, err)
+
+	_, err = os.Lstat(path.Join(tempDir, "etc/removed"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Lstat(path.Join(tempDir, "etc/.wh.removed"))
+	assert.True(t, os.IsNotExist(err))
+
+	info, err := os.Lstat(path.Join(tempDir, "etc/replaced"))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode())
+
+	entries, err := ioutil.ReadDir(path.Join(tempDir, "opaque"))
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "new", entries[0].Name())
+
+	data, err := ioutil.ReadFile(path.Join(tempDir, "kept"))
+	assert.Nil(t, err)
+	assert.Equal(t, "lower", string(data))
+}
+
+func TestExtractSavedImageEscape(t *testing.T) {
+	parentDir, err := ioutil.TempDir("", "platconf-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(parentDir)
+
+	extractDir := path.Join(parentDir, "root")
+	assert.Nil(t, os.Mkdir(extractDir, 0755))
+	assert.Nil(t, ioutil.WriteFile(path.Join(parentDir, "escaped"), []byte("outside"), 0644))
+
+	// the link is harmless until the second layer replaces 'a/up'
+	lowerLayer := makeTestTar(t, []testTarEntry{
+		{header: tar.Header{Name: "a/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "a/up/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "a/link", Typeflag: tar.TypeSymlink, Linkname: "up/../escaped"}},
+	})
+	upperLayer := makeTestTar(t, []testTarEntry{
+		{header: tar.Header{Name: "a/up", Typeflag: tar.TypeSymlink, Linkname: ".."}},
+	})
+	saved := makeTestTar(t, []testTarEntry{
+		{header: tar.Header{Name: "1.tar", Typeflag: tar.TypeReg, Mode: 0644}, body: lowerLayer.String()},
+		{header: tar.Header{Name: "2.tar", Typeflag: tar.TypeReg, Mode: 0644}, body: upperLayer.String()},
+		{header: tar.Header{Name: "manifest.json", Typeflag: tar.TypeReg, Mode: 0644}, body: `[{"Layers":["1.tar","2.tar"]}]`},
+	})
+
+	err = extractSavedImage(saved, extractDir)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,153 @@
+package update
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/experimental-platform/platconf/platconf"
+)
+
+// installedManifestPath is where finalize() stores the manifest of the
+// installed release, relative to the root directory
+const installedManifestPath = "etc/protonet/system/manifest.json"
+
+// installedRelease describes the release written by finalize()
+type installedRelease struct {
+	Build           int32  `json:"build"`
+	Codename        string `json:"codename"`
+	ReleaseNotesURL string `json:"release_notes_url"`
+}
+
+// readInstalledBuild returns the build number of the installed release
+func readInstalledBuild(rootDir string) (int32, error) {
+	data, err := ioutil.ReadFile(path.Join(rootDir, "etc/protonet/system/release_number"))
+	if err != nil {
+		return 0, err
+	}
+
+	build, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 32)
+	if err != nil {
+		return 0, err
+	}
+
+	return int32(build), nil
+}
+
+// readInstalledRelease reads back the release information written by finalize()
+func readInstalledRelease(rootDir string) (*installedRelease, error) {
+	build, err := readInstalledBuild(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// the following are informative only, so don't fail if they're missing
+	codename, _ := ioutil.ReadFile(path.Join(rootDir, "etc/protonet/system/codename"))
+	releaseNotesURL, _ := ioutil.ReadFile(path.Join(rootDir, "etc/protonet/system/release_notes_url"))
+
+	return &installedRelease{
+		Build:           build,
+		Codename:        strings.TrimSpace(string(codename)),
+		ReleaseNotesURL: strings.TrimSpace(string(releaseNotesURL)),
+	}, nil
+}
+
+// readInstalledManifest returns the manifest of the installed release
+func readInstalledManifest(rootDir string) (*platconf.ReleaseManifestV2, error) {
+	data, err := ioutil.ReadFile(path.Join(rootDir, installedManifestPath))
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest platconf.ReleaseManifestV2
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	return &manifest, nil
+}
+
+// areUnitsUnchanged checks whether the units rendered in the configure
+// directory are identical to the installed platform units
+func areUnitsUnchanged(rootDir, configureDir string) (bool, error) {
+	servicesDir := path.Join(configureDir, "services")
+	systemDir := path.Join(rootDir, "etc/systemd/system")
+
+	serviceFiles, err := ioutil.ReadDir(servicesDir)
+	if err != nil {
+		return false, err
+	}
+
+	rendered := make(map[string]bool)
+	for _, sf := range serviceFiles {
+		rendered[sf.Name()] = true
+
+		newData, err := ioutil.ReadFile(path.Join(servicesDir, sf.Name()))
+		if err != nil {
+			return false, err
+		}
+
+		installedData, err := ioutil.ReadFile(path.Join(systemDir, sf.Name()))
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		if !bytes.Equal(newData, installedData) {
+			return false, nil
+		}
+	}
+
+	// a platform unit that has been dropped from the release counts as a change too
+	installedUnits, err := listPlatformUnits(systemDir)
+	if err != nil {
+		return false, err
+	}
+
+	for _, u := range installedUnits {
+		// the postboot unit is installed by platconf itself
+		if !rendered[u] && u != postbootUnitName {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// isReleaseUnchanged checks whether the given release is already completely
+// installed: the build is the same, the rendered units equal the installed
+// ones and all images are present.
+func isReleaseUnchanged(rootDir, configureDir string, manifest *platconf.ReleaseManifestV2) (bool, error) {
+	build, err := readInstalledBuild(rootDir)
+	if err != nil {
+		// a missing or broken release number will be fixed by the update
+		log.Printf("Couldn't read the installed release number: %s\n", err.Error())
+		return false, nil
+	}
+
+	if build != manifest.Build {
+		return false, nil
+	}
+
+	unitsUnchanged, err := areUnitsUnchanged(rootDir, configureDir)
+	if err != nil || !unitsUnchanged {
+		return false, err
+	}
+
+	for _, img := range manifest.Images {
+		exists, err := imageExists(img.Name, img.Tag)
+		if err != nil || !exists {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
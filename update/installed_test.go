@@ -0,0 +1,108 @@
+package update
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/experimental-platform/platconf/platconf"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadInstalledRelease(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	// nothing installed yet
+	_, err = readInstalledRelease(tempDir)
+	assert.NotNil(t, err)
+
+	err = os.MkdirAll(path.Join(tempDir, "etc/protonet/system"), 0755)
+	assert.Nil(t, err)
+
+	manifest := platconf.ReleaseManifestV2{
+		Build:           1234,
+		Codename:        "Kaufman",
+		ReleaseNotesURL: "https://www.example.com/",
+	}
+	err = finalize(&manifest, tempDir)
+	assert.Nil(t, err)
+
+	release, err := readInstalledRelease(tempDir)
+	assert.Nil(t, err)
+	assert.Equal(t, installedRelease{Build: 1234, Codename: "Kaufman", ReleaseNotesURL: "https://www.example.com/"}, *release)
+
+	installedManifest, err := readInstalledManifest(tempDir)
+	assert.Nil(t, err)
+	assert.Equal(t, manifest, *installedManifest)
+
+	// garbage in the release number
+	err = ioutil.WriteFile(path.Join(tempDir, "etc/protonet/system/release_number"), []byte("foo"), 0644)
+	assert.Nil(t, err)
+	_, err = readInstalledBuild(tempDir)
+	assert.NotNil(t, err)
+}
+
+func TestAreUnitsUnchanged(t *testing.T) {
+	tempRootDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempRootDir)
+	fakeConfigureDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(fakeConfigureDir)
+
+	servicesDir := path.Join(fakeConfigureDir, "services")
+	systemDir := path.Join(tempRootDir, "etc/systemd/system")
+	assert.Nil(t, os.MkdirAll(servicesDir, 0755))
+	assert.Nil(t, os.MkdirAll(systemDir, 0755))
+
+	unit := []byte("# ExperimentalPlatform\n[Unit]\n")
+	assert.Nil(t, ioutil.WriteFile(path.Join(servicesDir, "foo.service"), unit, 0644))
+
+	// not installed yet
+	unchanged, err := areUnitsUnchanged(tempRootDir, fakeConfigureDir)
+	assert.Nil(t, err)
+	assert.False(t, unchanged)
+
+	// installed
+	assert.Nil(t, ioutil.WriteFile(path.Join(systemDir, "foo.service"), unit, 0644))
+	assert.Nil(t, ioutil.WriteFile(path.Join(systemDir, "custom.service"), []byte("[Unit]\n"), 0644))
+	assert.Nil(t, installPostbootUnit(tempRootDir))
+	unchanged, err = areUnitsUnchanged(tempRootDir, fakeConfigureDir)
+	assert.Nil(t, err)
+	assert.True(t, unchanged)
+
+	// modified
+	assert.Nil(t, ioutil.WriteFile(path.Join(systemDir, "foo.service"), []byte("# ExperimentalPlatform\n[Unit]\nfoo\n"), 0644))
+	unchanged, err = areUnitsUnchanged(tempRootDir, fakeConfigureDir)
+	assert.Nil(t, err)
+	assert.False(t, unchanged)
+
+	// left-over platform unit from an older release
+	assert.Nil(t, ioutil.WriteFile(path.Join(systemDir, "foo.service"), unit, 0644))
+	assert.Nil(t, ioutil.WriteFile(path.Join(systemDir, "old.service"), unit, 0644))
+	unchanged, err = areUnitsUnchanged(tempRootDir, fakeConfigureDir)
+	assert.Nil(t, err)
+	assert.False(t, unchanged)
+}
+
+func TestIsReleaseUnchangedOtherBuild(t *testing.T) {
+	tempRootDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempRootDir)
+
+	manifest := platconf.ReleaseManifestV2{Build: 1235}
+
+	// nothing installed
+	unchanged, err := isReleaseUnchanged(tempRootDir, "/nonexistent", &manifest)
+	assert.Nil(t, err)
+	assert.False(t, unchanged)
+
+	assert.Nil(t, os.MkdirAll(path.Join(tempRootDir, "etc/protonet/system"), 0755))
+	assert.Nil(t, ioutil.WriteFile(path.Join(tempRootDir, "etc/protonet/system/release_number"), []byte("1234"), 0644))
+	unchanged, err = isReleaseUnchanged(tempRootDir, "/nonexistent", &manifest)
+	assert.Nil(t, err)
+	assert.False(t, unchanged)
+}
@@ -0,0 +1,190 @@
+package update
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/experimental-platform/platconf/platconf"
+	"github.com/nightlyone/lockfile"
+)
+
+// updateLock is the update lock together with the information about its holder
+type updateLock struct {
+	lockfile.Lockfile
+	path string
+}
+
+// activeLock is the lock held by this process, its phase follows the status
+var activeLock *updateLock
+var activeLockMutex sync.Mutex
+
+// describeLockHolder tells who holds the lock at path and for how long
+func describeLockHolder(path string) string {
+	info, err := platconf.ReadLockInfo(path)
+	if err != nil {
+		lock, err := lockfile.New(path)
+		if err != nil {
+			return err.Error()
+		}
+		owner, err := lock.GetOwner()
+		if err != nil {
+			return fmt.Sprintf("'%s': %s", path, err.Error())
+		}
+		return fmt.Sprintf("PID %d", owner.Pid)
+	}
+
+	description := fmt.Sprintf("PID %d ('platconf %s'), in phase '%s' since %s (%s)",
+		info.PID, info.Command, info.Phase, info.StartedAt.Local().Format(time.RFC1123), time.Since(info.StartedAt)/time.Second*time.Second)
+	if info.FromOtherBoot() {
+		description += ", from before the last reboot"
+	}
+
+	return description
+}
+
+// removeLock removes the lock file and its information
+func removeLock(path string) error {
+	err := os.Remove(platconf.LockInfoPath(path))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	err = os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// lockUpdate takes the update lock at path. A lock taken before the last
+// reboot is removed, since a PID of the previous boot may be reused.
+func lockUpdate(path string) (*updateLock, error) {
+	lock, err := lockfile.New(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := platconf.ReadLockInfo(path)
+	if err == nil && info.FromOtherBoot() {
+		log.Printf("Removing the stale lock of %s\n", describeLockHolder(path))
+		err = removeLock(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = lock.TryLock()
+	if err == lockfile.ErrBusy {
+		return nil, fmt.Errorf("another platconf instance is already running an update: %s", describeLockHolder(path))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to obtain the lock '%s': %s", path, err.Error())
+	}
+
+	err = platconf.WriteLockInfo(path, &platconf.LockInfo{
+		PID:       os.Getpid(),
+		StartedAt: time.Now(),
+		Phase:     "started",
+		BootID:    platconf.BootID(),
+		Command:   strings.Join(os.Args[1:], " "),
+	})
+	if err != nil {
+		log.Printf("WARNING: failed to record the lock information: %s\n", err.Error())
+	}
+
+	l := &updateLock{Lockfile: lock, path: path}
+
+	activeLockMutex.Lock()
+	activeLock = l
+	activeLockMutex.Unlock()
+
+	return l, nil
+}
+
+// tryLockUpdate takes the update lock or exits
+func tryLockUpdate(path string) *updateLock {
+	lock, err := lockUpdate(path)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+
+	return lock
+}
+
+// Unlock releases the lock and removes its information
+func (l *updateLock) Unlock() error {
+	activeLockMutex.Lock()
+	if activeLock == l {
+		activeLock = nil
+	}
+	activeLockMutex.Unlock()
+
+	err := os.Remove(platconf.LockInfoPath(l.path))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("WARNING: failed to remove the lock information: %s\n", err.Error())
+	}
+
+	return l.Lockfile.Unlock()
+}
+
+// setLockPhase records the phase of the update in the lock information
+func setLockPhase(phase string) {
+	activeLockMutex.Lock()
+	defer activeLockMutex.Unlock()
+
+	if activeLock == nil {
+		return
+	}
+
+	info, err := platconf.ReadLockInfo(activeLock.path)
+	if err != nil {
+		return
+	}
+
+	info.Phase = phase
+	err = platconf.WriteLockInfo(activeLock.path, info)
+	if err != nil {
+		log.Printf("WARNING: failed to record the update phase: %s\n", err.Error())
+	}
+}
+
+// errLockHeld is returned by unlock if the lock holder is still running
+var errLockHeld = errors.New("the process holding the lock is still running")
+
+// unlock removes the lock at path if its holder is gone, or in any case if forced
+func unlock(path string, force bool) (bool, error) {
+	lock, err := lockfile.New(path)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = os.Stat(path)
+	if os.IsNotExist(err) {
+		// there may be an orphaned information file
+		return false, removeLock(path)
+	}
+
+	stale := false
+	_, err = lock.GetOwner()
+	if err == lockfile.ErrDeadOwner || err == lockfile.ErrInvalidPid {
+		stale = true
+	}
+
+	info, infoErr := platconf.ReadLockInfo(path)
+	if infoErr == nil && info.IsStale() {
+		stale = true
+	}
+
+	if !stale && !force {
+		return false, errLockHeld
+	}
+
+	return true, removeLock(path)
+}
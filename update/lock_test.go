@@ -0,0 +1,107 @@
+package update
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+
+	"github.com/experimental-platform/platconf/platconf"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockUpdate(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+	lockPath := path.Join(tempDir, "platconf.lock")
+
+	lock, err := lockUpdate(lockPath)
+	assert.Nil(t, err)
+
+	info, err := platconf.ReadLockInfo(lockPath)
+	assert.Nil(t, err)
+	assert.Equal(t, os.Getpid(), info.PID)
+	assert.Equal(t, "started", info.Phase)
+
+	setLockPhase("downloading")
+	info, err = platconf.ReadLockInfo(lockPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "downloading", info.Phase)
+	assert.Contains(t, describeLockHolder(lockPath), "in phase 'downloading'")
+
+	assert.Nil(t, lock.Unlock())
+	_, err = os.Stat(lockPath)
+	assert.True(t, os.IsNotExist(err))
+	_, err = platconf.ReadLockInfo(lockPath)
+	assert.True(t, os.IsNotExist(err))
+
+	// no lock held anymore
+	setLockPhase("finished")
+	_, err = platconf.ReadLockInfo(lockPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestLockUpdateOtherBoot(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+	lockPath := path.Join(tempDir, "platconf.lock")
+
+	defer func(p string) { platconf.BootIDPath = p }(platconf.BootIDPath)
+	platconf.BootIDPath = path.Join(tempDir, "boot_id")
+	assert.Nil(t, ioutil.WriteFile(platconf.BootIDPath, []byte("current\n"), 0644))
+
+	// PID 1 is alive, but it took the lock before the reboot
+	assert.Nil(t, ioutil.WriteFile(lockPath, []byte("1\n"), 0644))
+	assert.Nil(t, platconf.WriteLockInfo(lockPath, &platconf.LockInfo{PID: 1, BootID: "previous"}))
+
+	lock, err := lockUpdate(lockPath)
+	assert.Nil(t, err)
+	info, err := platconf.ReadLockInfo(lockPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "current", info.BootID)
+	assert.Nil(t, lock.Unlock())
+
+	// the same from this boot is a running update
+	assert.Nil(t, ioutil.WriteFile(lockPath, []byte("1\n"), 0644))
+	assert.Nil(t, platconf.WriteLockInfo(lockPath, &platconf.LockInfo{PID: 1, BootID: "current"}))
+	_, err = lockUpdate(lockPath)
+	assert.NotNil(t, err)
+}
+
+func TestUnlock(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+	lockPath := path.Join(tempDir, "platconf.lock")
+
+	removed, err := unlock(lockPath, false)
+	assert.Nil(t, err)
+	assert.False(t, removed)
+
+	// held by a running process
+	assert.Nil(t, ioutil.WriteFile(lockPath, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644))
+	removed, err = unlock(lockPath, false)
+	assert.Equal(t, errLockHeld, err)
+	assert.False(t, removed)
+
+	removed, err = unlock(lockPath, true)
+	assert.Nil(t, err)
+	assert.True(t, removed)
+	_, err = os.Stat(lockPath)
+	assert.True(t, os.IsNotExist(err))
+
+	// held by a process which is gone
+	cmd := exec.Command("true")
+	assert.Nil(t, cmd.Run())
+	assert.Nil(t, ioutil.WriteFile(lockPath, []byte(fmt.Sprintf("%d\n", cmd.Process.Pid)), 0644))
+	assert.Nil(t, platconf.WriteLockInfo(lockPath, &platconf.LockInfo{PID: cmd.Process.Pid}))
+	removed, err = unlock(lockPath, false)
+	assert.Nil(t, err)
+	assert.True(t, removed)
+	_, err = platconf.ReadLockInfo(lockPath)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -1,10 +1,13 @@
 package update
 
-import "os/exec"
+import (
+	"context"
+	"os/exec"
+)
 
 // TODO perhaps make this a parallel thread in the future?
 
-func performOSUpdate() error {
-	cmd := exec.Command("/usr/bin/update_engine_client", "-update")
+func performOSUpdate(ctx context.Context) error {
+	cmd := exec.CommandContext(ctx, "/usr/bin/update_engine_client", "-update")
 	return cmd.Run()
 }
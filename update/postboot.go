@@ -0,0 +1,461 @@
+package update
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/experimental-platform/platconf/platconf"
+)
+
+// platconfBinary is the installed binary the postboot unit runs
+var platconfBinary = "/opt/bin/platconf"
+
+// postbootUnitName is the unit running 'platconf postboot' on every boot
+const postbootUnitName = "platconf-postboot.service"
+
+// postbootUnit runs after the other units have been started, without
+// delaying multi-user.target while it waits for them
+const postbootUnit = `# ExperimentalPlatform
+[Unit]
+Description=Verify the platform units after an update
+DefaultDependencies=no
+Requires=sysinit.target
+After=sysinit.target basic.target docker.service
+Conflicts=shutdown.target
+Before=shutdown.target
+
+[Service]
+Type=oneshot
+TimeoutStartSec=0
+ExecStart=%s postboot
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// postbootPollInterval is the time between two checks of the unit states
+var postbootPollInterval = 5 * time.Second
+
+// results recorded by postboot
+const (
+	postbootOK         = "ok"
+	postbootFailed     = "failed"
+	postbootRolledBack = "rolled-back"
+)
+
+// PostbootOpts contains command line parameters for the 'postboot' command
+type PostbootOpts struct {
+	Timeout    time.Duration `long:"timeout" description:"Time the platform units have to become active" default:"10m"`
+	MaxFailed  int           `long:"max-failed" description:"Number of failed units triggering a rollback" default:"1"`
+	NoRollback bool          `long:"no-rollback" description:"Only report failed units instead of rolling back"`
+
+	SystemdTimeout time.Duration `long:"systemd-timeout" description:"Timeout for setting up the systemd units while rolling back, 0 disables it" default:"5m"`
+
+	// the images of the release rolled back to may have to be pulled again
+	PullOpts
+
+	Config *platconf.Config `no-flag:"true"`
+}
+
+// postbootState records the outcome of the first boot of a build
+type postbootState struct {
+	Build        int32     `json:"build"`
+	Result       string    `json:"result"`
+	CheckedAt    time.Time `json:"checked_at"`
+	FailedUnits  []string  `json:"failed_units"`
+	RolledBackTo int32     `json:"rolled_back_to,omitempty"`
+}
+
+func postbootStatePath(rootDir string) string {
+	return path.Join(rootDir, dataDir, "postboot.json")
+}
+
+// installPostbootUnit writes the postboot unit, it's enabled with the platform units
+func installPostbootUnit(rootDir string) error {
+	unit := fmt.Sprintf(postbootUnit, platconfBinary)
+	return ioutil.WriteFile(path.Join(rootDir, "etc/systemd/system", postbootUnitName), []byte(unit), 0644)
+}
+
+// readPostbootState returns the recorded state, which is empty if
+// postboot has never run
+func readPostbootState(rootDir string) (*postbootState, error) {
+	var state postbootState
+
+	data, err := ioutil.ReadFile(postbootStatePath(rootDir))
+	if os.IsNotExist(err) {
+		return &state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, fmt.Errorf("readPostbootState: %s", err.Error())
+	}
+
+	return &state, nil
+}
+
+func writePostbootState(rootDir string, state *postbootState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(path.Dir(postbootStatePath(rootDir)), 0755)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(postbootStatePath(rootDir), data, 0644)
+}
+
+// unitRunState is the state of a unit as far as postboot is concerned
+type unitRunState struct {
+	ActiveState string
+	// Result and Started are only set for inactive services
+	Result  string
+	Started bool
+}
+
+// unitTriggers are the unit types which start a service of their own, by
+// the sections which may name another one with 'Unit='
+var unitTriggers = map[string]string{
+	".timer":  "Timer",
+	".path":   "Path",
+	".socket": "Socket",
+}
+
+// readUnitFile returns the values of a unit file by section and key
+func readUnitFile(unitPath string) (map[string]map[string][]string, error) {
+	f, err := os.Open(unitPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sections := make(map[string]map[string][]string)
+	var section map[string][]string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			name := line[1 : len(line)-1]
+			if sections[name] == nil {
+				sections[name] = make(map[string][]string)
+			}
+			section = sections[name]
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if section == nil || len(parts) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(parts[0])
+		section[key] = append(section[key], strings.Fields(parts[1])...)
+	}
+
+	return sections, scanner.Err()
+}
+
+// checkedUnits returns the units which have to become active by themselves:
+// enabled units with an install target, except for the services started by
+// a timer, path or socket unit, which are only started on demand
+func checkedUnits(ctx context.Context, dir string, units []string, fileState func(context.Context, string) (string, error)) []string {
+	unitFiles := make(map[string]map[string]map[string][]string)
+	triggered := make(map[string]bool)
+	for _, u := range units {
+		if u == postbootUnitName || strings.Contains(u, "@.") {
+			continue
+		}
+
+		sections, err := readUnitFile(path.Join(dir, u))
+		if err != nil {
+			log.Printf("Reading '%s': %s\n", u, err.Error())
+			continue
+		}
+		unitFiles[u] = sections
+
+		for suffix, sectionName := range unitTriggers {
+			if !strings.HasSuffix(u, suffix) {
+				continue
+			}
+
+			target := strings.TrimSuffix(u, suffix) + ".service"
+			if units := sections[sectionName]["Unit"]; len(units) > 0 {
+				target = units[0]
+			}
+			triggered[target] = true
+		}
+	}
+
+	checked := []string{}
+	for _, u := range units {
+		sections, ok := unitFiles[u]
+		if !ok || triggered[u] {
+			continue
+		}
+
+		install := sections["Install"]
+		if len(install["WantedBy"]) == 0 && len(install["RequiredBy"]) == 0 {
+			continue
+		}
+
+		state, err := fileState(ctx, u)
+		if err != nil {
+			log.Printf("Getting the unit file state of '%s': %s\n", u, err.Error())
+			continue
+		}
+		if state != "enabled" {
+			continue
+		}
+
+		checked = append(checked, u)
+	}
+
+	return checked
+}
+
+// waitForUnits polls the units until all of them are up, maxFailed of them
+// have failed or the context is done. A unit is up once it's active or, for
+// oneshot services, once it has exited successfully. Units which are still
+// activating by the deadline count as failed, units which haven't been
+// started at all don't.
+func waitForUnits(ctx context.Context, units []string, maxFailed int, unitState func(context.Context, string) (unitRunState, error)) []string {
+	pending := make(map[string]bool)
+	for _, u := range units {
+		pending[u] = true
+	}
+	lastState := make(map[string]string)
+	failed := []string{}
+
+	for {
+		for _, u := range units {
+			if !pending[u] {
+				continue
+			}
+
+			status, err := unitState(ctx, u)
+			if err != nil {
+				log.Printf("Getting the state of '%s': %s\n", u, err.Error())
+				continue
+			}
+			lastState[u] = status.ActiveState
+
+			switch {
+			case status.ActiveState == "active":
+				delete(pending, u)
+			case status.ActiveState == "inactive" && status.Started && status.Result == "success":
+				delete(pending, u)
+			case status.ActiveState == "failed":
+				log.Printf("Unit '%s' failed\n", u)
+				delete(pending, u)
+				failed = append(failed, u)
+			}
+		}
+
+		if len(pending) == 0 || len(failed) >= maxFailed {
+			return failed
+		}
+
+		select {
+		case <-time.After(postbootPollInterval):
+		case <-ctx.Done():
+			for _, u := range units {
+				if !pending[u] {
+					continue
+				}
+
+				if lastState[u] == "activating" {
+					log.Printf("Unit '%s' didn't become active in time\n", u)
+					failed = append(failed, u)
+				} else {
+					log.Printf("WARNING: unit '%s' is '%s', not counting it as failed\n", u, lastState[u])
+				}
+			}
+			return failed
+		}
+	}
+}
+
+// previousArchivedRelease returns the most recently archived release
+// other than the given build
+func previousArchivedRelease(rootDir string, build int32) (*archivedRelease, *platconf.ReleaseManifestV2, error) {
+	releases, err := listArchivedReleases(rootDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, r := range releases {
+		if r.Build != build {
+			return getArchivedRelease(rootDir, r.Build)
+		}
+	}
+
+	return nil, nil, fmt.Errorf("there is no archived release to roll back to")
+}
+
+// rollbackRelease reinstalls an archived release, pulling its images
+// again if they have been removed in the meantime
+func rollbackRelease(ctx context.Context, o *PostbootOpts, rootDir string, release *archivedRelease, manifest *platconf.ReleaseManifestV2) error {
+	missing := platconf.ReleaseManifestV2{Build: manifest.Build}
+	for _, img := range manifest.Images {
+		exists, err := imageExists(img.Name, img.Tag)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			missing.Images = append(missing.Images, img)
+		}
+	}
+
+	if len(missing.Images) > 0 {
+		pullCtx, cancel := phaseContext(ctx, o.PullTimeout)
+		err := pullAllImages(pullCtx, &missing, o.Pullers, o.PullRetries, nil)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Rolling back to build %d from '%s'\n", manifest.Build, release.Dir)
+	err := reinstallRelease(ctx, rootDir, release.ConfigureDir, o.SystemdTimeout)
+	if err != nil {
+		return err
+	}
+
+	return finalize(manifest, rootDir)
+}
+
+// runPostboot checks the platform units after the first boot of a build
+// and rolls back if too many of them fail. It returns whether a reboot
+// into the previous release is needed.
+func runPostboot(ctx context.Context, o *PostbootOpts, rootDir string) (bool, error) {
+	build, err := readInstalledBuild(rootDir)
+	if os.IsNotExist(err) {
+		log.Println("No release installed, nothing to check")
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	state, err := readPostbootState(rootDir)
+	if err != nil {
+		return false, err
+	}
+
+	if state.Build == build && state.Result != "" {
+		log.Printf("Build %d has been checked at %s already: %s\n", build, state.CheckedAt.Format(time.RFC3339), state.Result)
+		return false, nil
+	}
+
+	// don't roll back in circles if the release rolled back to fails as well
+	rollbackAllowed := !o.NoRollback && !(state.Result == postbootRolledBack && state.RolledBackTo == build)
+
+	unitDir := path.Join(rootDir, "etc/systemd/system")
+	units, err := listPlatformUnits(unitDir)
+	if err != nil {
+		return false, err
+	}
+	units = checkedUnits(ctx, unitDir, units, systemdGetUnitFileState)
+
+	log.Printf("Waiting up to %s for %d units of build %d\n", o.Timeout, len(units), build)
+	waitCtx, cancel := phaseContext(ctx, o.Timeout)
+	failed := waitForUnits(waitCtx, units, o.MaxFailed, systemdGetUnitStatus)
+	cancel()
+
+	newState := postbootState{Build: build, CheckedAt: time.Now().UTC(), FailedUnits: failed}
+	if len(failed) < o.MaxFailed {
+		log.Printf("Build %d is up, %d of %d units failed\n", build, len(failed), len(units))
+		newState.Result = postbootOK
+		return false, writePostbootState(rootDir, &newState)
+	}
+
+	if !rollbackAllowed {
+		newState.Result = postbootFailed
+		errMsg := fmt.Sprintf("build %d failed to start: %v", build, failed)
+		setStatus("failed", nil, &errMsg)
+		err = writePostbootState(rootDir, &newState)
+		if err != nil {
+			log.Printf("Recording the result: %s\n", err.Error())
+		}
+		return false, fmt.Errorf("%s, not rolling back", errMsg)
+	}
+
+	release, manifest, err := previousArchivedRelease(rootDir, build)
+	if err != nil {
+		return false, fmt.Errorf("build %d failed to start: %v, rolling back: %s", build, failed, err.Error())
+	}
+
+	lock := tryLockUpdate(lockfilePath)
+	defer lock.Unlock()
+
+	// recorded first, so a failing rollback isn't retried on every boot
+	newState.Result = postbootRolledBack
+	newState.RolledBackTo = manifest.Build
+	err = writePostbootState(rootDir, &newState)
+	if err != nil {
+		return false, err
+	}
+
+	err = rollbackRelease(ctx, o, rootDir, release, manifest)
+	if err != nil {
+		return false, fmt.Errorf("build %d failed to start: %v, rolling back to build %d: %s", build, failed, manifest.Build, err.Error())
+	}
+
+	errMsg := fmt.Sprintf("build %d failed to start: %v, rolled back to build %d", build, failed, manifest.Build)
+	setStatus("failed", nil, &errMsg)
+	log.Println(errMsg)
+
+	return true, nil
+}
+
+// Execute is the function ran when the 'postboot' command is used
+func (o *PostbootOpts) Execute(args []string) error {
+	os.Setenv("DOCKER_API_VERSION", "1.22")
+
+	if o.MaxFailed < 1 {
+		return fmt.Errorf("--max-failed must be > 0")
+	}
+
+	if o.Pullers < 1 {
+		return fmt.Errorf("The maximum number of pullers must be > 0")
+	}
+
+	applyConfig(o.Config)
+	platconf.RequireRoot()
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	reboot, err := runPostboot(ctx, o, "/")
+	if err != nil {
+		showButtonPhase("failed")
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if reboot {
+		log.Println("Triggering a reboot")
+		rebootCmd := exec.Command("/usr/sbin/shutdown", "--reboot", "1")
+		rebootCmd.Run()
+	}
+
+	return nil
+}
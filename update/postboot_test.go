@@ -0,0 +1,164 @@
+package update
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/experimental-platform/platconf/platconf"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckedUnits(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	unitFiles := map[string]string{
+		"foo.service":      "[Unit]\nDescription=foo\n\n[Service]\nExecStart=/bin/foo\n\n[Install]\nWantedBy=multi-user.target\n",
+		"oneshot.service":  "[Service]\nType=oneshot\nExecStart=/bin/true\n\n[Install]\nWantedBy=multi-user.target\n",
+		"cleanup.timer":    "[Timer]\nOnCalendar=daily\n\n[Install]\nWantedBy=timers.target\n",
+		"cleanup.service":  "[Service]\nType=oneshot\nExecStart=/bin/cleanup\n",
+		"trigger.path":     "[Path]\nPathChanged=/etc/foo\nUnit=update.service\n\n[Install]\nWantedBy=multi-user.target\n",
+		"update.service":   "[Service]\nExecStart=/bin/update\n\n[Install]\nWantedBy=multi-user.target\n",
+		"api.socket":       "[Socket]\nListenStream=80\n\n[Install]\nWantedBy=sockets.target\n",
+		"api.service":      "[Service]\nExecStart=/bin/api\n\n[Install]\nWantedBy=multi-user.target\n",
+		"helper.service":   "[Service]\nExecStart=/bin/helper\n",
+		"disabled.service": "[Service]\nExecStart=/bin/disabled\n\n[Install]\nWantedBy=multi-user.target\n",
+		"bar@.service":     "[Service]\nExecStart=/bin/bar %i\n\n[Install]\nWantedBy=multi-user.target\n",
+		"bar@1.service":    "[Service]\nExecStart=/bin/bar 1\n\n[Install]\nRequiredBy=multi-user.target\n",
+		postbootUnitName:   fmt.Sprintf(postbootUnit, "/opt/bin/platconf"),
+	}
+	units := []string{}
+	for name, content := range unitFiles {
+		assert.Nil(t, ioutil.WriteFile(path.Join(tempDir, name), []byte(content), 0644))
+		units = append(units, name)
+	}
+	sort.Strings(units)
+
+	fileState := func(ctx context.Context, unit string) (string, error) {
+		if unit == "disabled.service" {
+			return "disabled", nil
+		}
+		return "enabled", nil
+	}
+
+	checked := checkedUnits(context.Background(), tempDir, units, fileState)
+	assert.Equal(t, []string{"api.socket", "bar@1.service", "cleanup.timer", "foo.service", "oneshot.service", "trigger.path"}, checked)
+}
+
+func TestWaitForUnits(t *testing.T) {
+	defer func(d time.Duration) { postbootPollInterval = d }(postbootPollInterval)
+	postbootPollInterval = 10 * time.Millisecond
+
+	polls := make(map[string]int)
+	unitState := func(ctx context.Context, unit string) (unitRunState, error) {
+		polls[unit]++
+		switch unit {
+		case "slow.service":
+			if polls[unit] < 3 {
+				return unitRunState{ActiveState: "activating"}, nil
+			}
+			return unitRunState{ActiveState: "active"}, nil
+		case "broken.service":
+			return unitRunState{ActiveState: "failed"}, nil
+		case "flaky.service":
+			if polls[unit] < 2 {
+				return unitRunState{}, errors.New("no reply")
+			}
+			return unitRunState{ActiveState: "active"}, nil
+		case "stuck.service":
+			return unitRunState{ActiveState: "activating"}, nil
+		case "oneshot.service":
+			return unitRunState{ActiveState: "inactive", Result: "success", Started: true}, nil
+		case "unstarted.service":
+			return unitRunState{ActiveState: "inactive", Result: "success"}, nil
+		}
+		return unitRunState{ActiveState: "active"}, nil
+	}
+
+	failed := waitForUnits(context.Background(), []string{"fast.service", "slow.service", "flaky.service", "oneshot.service"}, 1, unitState)
+	assert.Len(t, failed, 0)
+	assert.Equal(t, 1, polls["fast.service"])
+	assert.Equal(t, 3, polls["slow.service"])
+	assert.Equal(t, 1, polls["oneshot.service"])
+
+	// gives up as soon as enough units failed
+	failed = waitForUnits(context.Background(), []string{"broken.service", "stuck.service"}, 1, unitState)
+	assert.Equal(t, []string{"broken.service"}, failed)
+
+	// units still activating by the deadline count as failed, units which
+	// haven't been started don't
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	failed = waitForUnits(ctx, []string{"broken.service", "stuck.service", "unstarted.service", "fast.service"}, 3, unitState)
+	assert.Equal(t, []string{"broken.service", "stuck.service"}, failed)
+}
+
+func TestPreviousArchivedRelease(t *testing.T) {
+	tempRootDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempRootDir)
+	fakeConfigureDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(fakeConfigureDir)
+
+	_, _, err = previousArchivedRelease(tempRootDir, 200)
+	assert.NotNil(t, err)
+
+	for _, build := range []int32{100, 200} {
+		err = archiveRelease(tempRootDir, fakeConfigureDir, &platconf.ReleaseManifestV2{Build: build})
+		assert.Nil(t, err)
+		// the archive is sorted by modification time
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	release, manifest, err := previousArchivedRelease(tempRootDir, 200)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 100, release.Build)
+	assert.EqualValues(t, 100, manifest.Build)
+}
+
+func TestRunPostboot(t *testing.T) {
+	tempRootDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempRootDir)
+
+	o := &PostbootOpts{Timeout: time.Second, MaxFailed: 1}
+
+	// nothing installed
+	reboot, err := runPostboot(context.Background(), o, tempRootDir)
+	assert.Nil(t, err)
+	assert.False(t, reboot)
+
+	assert.Nil(t, os.MkdirAll(path.Join(tempRootDir, "etc/protonet/system"), 0755))
+	assert.Nil(t, os.MkdirAll(path.Join(tempRootDir, "etc/systemd/system"), 0755))
+	assert.Nil(t, ioutil.WriteFile(path.Join(tempRootDir, "etc/protonet/system/release_number"), []byte("1234"), 0644))
+	assert.Nil(t, installPostbootUnit(tempRootDir))
+
+	// the postboot unit itself isn't waited for
+	reboot, err = runPostboot(context.Background(), o, tempRootDir)
+	assert.Nil(t, err)
+	assert.False(t, reboot)
+
+	state, err := readPostbootState(tempRootDir)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1234, state.Build)
+	assert.Equal(t, postbootOK, state.Result)
+
+	// a build is checked once only
+	state.Result = postbootFailed
+	assert.Nil(t, writePostbootState(tempRootDir, state))
+	reboot, err = runPostboot(context.Background(), o, tempRootDir)
+	assert.Nil(t, err)
+	assert.False(t, reboot)
+	state, err = readPostbootState(tempRootDir)
+	assert.Nil(t, err)
+	assert.Equal(t, postbootFailed, state.Result)
+}
@@ -0,0 +1,290 @@
+package update
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/experimental-platform/platconf/platconf"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/nightlyone/lockfile"
+)
+
+// preflightTimeout limits all pre-flight checks together
+const preflightTimeout = 30 * time.Second
+
+// defaultImageSizeEstimate is assumed for images without an older local version
+const defaultImageSizeEstimate = 512 << 20
+
+// freeSpaceReserve is kept free on the Docker root in addition to the images
+const freeSpaceReserve = 512 << 20
+
+// minSaneTime is the earliest time a clock is considered set
+var minSaneTime = time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// preflightResult is the outcome of a single pre-flight check
+type preflightResult struct {
+	Check   string `json:"check"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message"`
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	default:
+		return fmt.Sprintf("%d bytes", n)
+	}
+}
+
+// splitRepoTag splits 'name:tag', the name may contain a registry port
+func splitRepoTag(repoTag string) (string, string) {
+	i := strings.LastIndex(repoTag, ":")
+	if i < 0 || i < strings.LastIndex(repoTag, "/") {
+		return repoTag, ""
+	}
+
+	return repoTag[:i], repoTag[i+1:]
+}
+
+// estimatePullSize estimates the disk space needed for the images of the
+// manifest which aren't present yet. The size of an image is taken from
+// the largest local image of the same repository, since updates usually
+// change a few layers only this rather overestimates the size.
+func estimatePullSize(manifest *platconf.ReleaseManifestV2, local []docker.APIImages) int64 {
+	present := make(map[string]bool)
+	sizeByRepo := make(map[string]int64)
+	for _, img := range local {
+		for _, repoTag := range img.RepoTags {
+			present[repoTag] = true
+			repo, _ := splitRepoTag(repoTag)
+			if img.VirtualSize > sizeByRepo[repo] {
+				sizeByRepo[repo] = img.VirtualSize
+			}
+		}
+	}
+
+	var total int64
+	for _, img := range manifest.Images {
+		name := mirroredImageName(img.Name)
+		if present[name+":"+img.Tag] {
+			continue
+		}
+
+		if size, ok := sizeByRepo[name]; ok {
+			total += size
+		} else {
+			total += defaultImageSizeEstimate
+		}
+	}
+
+	return total
+}
+
+// checkLockFree makes sure no other process holds the update lock
+func checkLockFree() preflightResult {
+	result := preflightResult{Check: "update lock"}
+
+	lock, err := lockfile.New(lockfilePath)
+	if err != nil {
+		result.Message = err.Error()
+		return result
+	}
+
+	owner, err := lock.GetOwner()
+	switch {
+	case err == nil && owner.Pid != os.Getpid():
+		result.Message = fmt.Sprintf("'%s' is held by %s", lockfilePath, describeLockHolder(lockfilePath))
+	case err == nil:
+		result.OK = true
+		result.Message = "held by this process"
+	case os.IsNotExist(err) || err == lockfile.ErrDeadOwner || err == lockfile.ErrInvalidPid:
+		result.OK = true
+		result.Message = "free"
+	default:
+		result.Message = err.Error()
+	}
+
+	return result
+}
+
+// dockerCallWithContext runs a Docker API call without context support,
+// giving up waiting for it when the context is done
+func dockerCallWithContext(ctx context.Context, call func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- call()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// checkDocker makes sure the daemon answers and has room for the images of
+// the manifest in addition to the given number of bytes
+func checkDocker(ctx context.Context, manifest *platconf.ReleaseManifestV2, needed int64) []preflightResult {
+	daemon := preflightResult{Check: "docker daemon"}
+	disk := preflightResult{Check: "disk space"}
+
+	client, err := docker.NewClientFromEnv()
+	if err == nil {
+		err = dockerCallWithContext(ctx, client.Ping)
+	}
+	if err != nil {
+		daemon.Message = err.Error()
+		disk.Message = "unknown, the Docker daemon isn't reachable"
+		return []preflightResult{daemon, disk}
+	}
+	daemon.OK = true
+	daemon.Message = "reachable"
+
+	var info *docker.DockerInfo
+	err = dockerCallWithContext(ctx, func() error {
+		var err error
+		info, err = client.Info()
+		return err
+	})
+	if err != nil {
+		disk.Message = fmt.Sprintf("getting the Docker root: %s", err.Error())
+		return []preflightResult{daemon, disk}
+	}
+
+	if manifest != nil {
+		local, err := client.ListImages(docker.ListImagesOptions{Context: ctx})
+		if err != nil {
+			disk.Message = fmt.Sprintf("listing the images: %s", err.Error())
+			return []preflightResult{daemon, disk}
+		}
+		needed += estimatePullSize(manifest, local)
+	}
+
+	free, err := freeSpace(info.DockerRootDir)
+	if err != nil {
+		disk.Message = fmt.Sprintf("checking '%s': %s", info.DockerRootDir, err.Error())
+		return []preflightResult{daemon, disk}
+	}
+
+	disk.Message = fmt.Sprintf("%s free on '%s', about %s needed", formatBytes(free), info.DockerRootDir, formatBytes(needed+freeSpaceReserve))
+	disk.OK = free >= needed+freeSpaceReserve
+	return []preflightResult{daemon, disk}
+}
+
+func checkSystemd(ctx context.Context) preflightResult {
+	result := preflightResult{Check: "systemd"}
+
+	err := systemdPing(ctx)
+	if err != nil {
+		result.Message = fmt.Sprintf("not reachable over D-Bus: %s", err.Error())
+		return result
+	}
+
+	result.OK = true
+	result.Message = "reachable over D-Bus"
+	return result
+}
+
+// checkWritable makes sure files can be created in dir or, if it doesn't
+// exist yet, in its closest existing parent
+func checkWritable(dir string) preflightResult {
+	result := preflightResult{Check: "writable " + dir}
+
+	for {
+		_, err := os.Stat(dir)
+		if err == nil || !os.IsNotExist(err) || dir == path.Dir(dir) {
+			break
+		}
+		dir = path.Dir(dir)
+	}
+
+	f, err := ioutil.TempFile(dir, ".platconf-preflight-")
+	if err != nil {
+		result.Message = err.Error()
+		return result
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	result.OK = true
+	result.Message = "ok"
+	return result
+}
+
+// checkClock makes sure the clock has been set and isn't behind the release
+func checkClock(now time.Time, manifest *platconf.ReleaseManifestV2) preflightResult {
+	result := preflightResult{Check: "clock"}
+
+	if now.Before(minSaneTime) {
+		result.Message = fmt.Sprintf("the clock is set to %s, which can't be right", now.Format(time.RFC3339))
+		return result
+	}
+
+	if manifest != nil {
+		published, err := time.Parse(time.RFC3339, manifest.PublishedAt)
+		// allow for time zone mistakes in the manifest
+		if err == nil && now.Before(published.Add(-24*time.Hour)) {
+			result.Message = fmt.Sprintf("the clock is set to %s, before build %d has been published at %s", now.Format(time.RFC3339), manifest.Build, manifest.PublishedAt)
+			return result
+		}
+	}
+
+	result.OK = true
+	result.Message = now.Format(time.RFC3339)
+	return result
+}
+
+// runPreflightChecks checks whether an update can be installed. The space
+// needed for the images of the manifest is estimated and added to needed.
+func runPreflightChecks(ctx context.Context, rootDir string, manifest *platconf.ReleaseManifestV2, needed int64) []preflightResult {
+	ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+
+	results := []preflightResult{checkLockFree()}
+	results = append(results, checkDocker(ctx, manifest, needed)...)
+	results = append(results, checkSystemd(ctx))
+	results = append(results, checkWritable(path.Join(rootDir, "etc/protonet")))
+	results = append(results, checkClock(time.Now(), manifest))
+
+	return results
+}
+
+func printPreflightResults(w io.Writer, results []preflightResult) {
+	for _, r := range results {
+		status := " OK "
+		if !r.OK {
+			status = "FAIL"
+		}
+		fmt.Fprintf(w, "[%s] %s: %s\n", status, r.Check, r.Message)
+	}
+}
+
+// preflight runs the pre-flight checks and returns an error listing the
+// failed ones
+func preflight(ctx context.Context, rootDir string, manifest *platconf.ReleaseManifestV2, needed int64) error {
+	results := runPreflightChecks(ctx, rootDir, manifest, needed)
+
+	failed := []string{}
+	for _, r := range results {
+		if !r.OK {
+			failed = append(failed, r.Check)
+		}
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+
+	printPreflightResults(os.Stderr, results)
+	return fmt.Errorf("pre-flight checks failed: %s. Use --skip-preflight to update anyway", strings.Join(failed, ", "))
+}
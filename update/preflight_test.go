@@ -0,0 +1,110 @@
+package update
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/experimental-platform/platconf/platconf"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitRepoTag(t *testing.T) {
+	repo, tag := splitRepoTag("quay.io/experimentalplatform/configure:v1")
+	assert.Equal(t, "quay.io/experimentalplatform/configure", repo)
+	assert.Equal(t, "v1", tag)
+
+	repo, tag = splitRepoTag("mirror:5000/experimentalplatform/configure")
+	assert.Equal(t, "mirror:5000/experimentalplatform/configure", repo)
+	assert.Equal(t, "", tag)
+}
+
+func TestEstimatePullSize(t *testing.T) {
+	manifest := &platconf.ReleaseManifestV2{
+		Images: []platconf.ReleaseManifestV2Image{
+			{Name: "quay.io/experimentalplatform/present", Tag: "v2"},
+			{Name: "quay.io/experimentalplatform/updated", Tag: "v2"},
+			{Name: "quay.io/experimentalplatform/new", Tag: "v1"},
+		},
+	}
+	local := []docker.APIImages{
+		{RepoTags: []string{"quay.io/experimentalplatform/present:v2"}, VirtualSize: 1000},
+		{RepoTags: []string{"quay.io/experimentalplatform/updated:v1"}, VirtualSize: 300},
+		{RepoTags: []string{"quay.io/experimentalplatform/updated:v0"}, VirtualSize: 200},
+	}
+
+	assert.Equal(t, int64(300+defaultImageSizeEstimate), estimatePullSize(manifest, local))
+}
+
+func TestDockerCallWithContext(t *testing.T) {
+	testErr := errors.New("no daemon")
+	err := dockerCallWithContext(context.Background(), func() error { return testErr })
+	assert.Equal(t, testErr, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	block := make(chan struct{})
+	defer close(block)
+	err = dockerCallWithContext(ctx, func() error {
+		<-block
+		return nil
+	})
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestCheckClock(t *testing.T) {
+	manifest := &platconf.ReleaseManifestV2{Build: 1, PublishedAt: "2017-06-01T12:00:00Z"}
+
+	assert.False(t, checkClock(time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC), nil).OK)
+	assert.True(t, checkClock(time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC), nil).OK)
+	assert.False(t, checkClock(time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC), manifest).OK)
+	assert.True(t, checkClock(time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC), manifest).OK)
+
+	// an unparsable date doesn't fail the check
+	manifest.PublishedAt = "yesterday"
+	assert.True(t, checkClock(time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC), manifest).OK)
+}
+
+func TestCheckWritable(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	assert.True(t, checkWritable(tempDir).OK)
+	// the closest existing parent is checked
+	assert.True(t, checkWritable(path.Join(tempDir, "etc/protonet")).OK)
+
+	entries, err := ioutil.ReadDir(tempDir)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 0)
+
+	if os.Getuid() != 0 {
+		assert.Nil(t, os.Chmod(tempDir, 0555))
+		defer os.Chmod(tempDir, 0755)
+		assert.False(t, checkWritable(tempDir).OK)
+	}
+}
+
+func TestCheckLockFree(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	defer func(p string) { lockfilePath = p }(lockfilePath)
+	lockfilePath = path.Join(tempDir, "platconf.lock")
+
+	assert.True(t, checkLockFree().OK)
+
+	// PID 1 is always alive
+	assert.Nil(t, ioutil.WriteFile(lockfilePath, []byte("1\n"), 0644))
+	assert.False(t, checkLockFree().OK)
+
+	assert.Nil(t, ioutil.WriteFile(lockfilePath, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644))
+	assert.True(t, checkLockFree().OK)
+}
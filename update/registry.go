@@ -0,0 +1,224 @@
+package update
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// dockerHubRegistry is the registry of image names without a host
+const dockerHubRegistry = "docker.io"
+
+// registryMirror replaces 'quay.io' in image names if set, an 'http://'
+// prefix marks a mirror which only serves plain HTTP
+var registryMirror = ""
+
+// mirrorHost returns the host of the registry mirror without the scheme
+func mirrorHost() string {
+	host := strings.TrimPrefix(strings.TrimPrefix(registryMirror, "http://"), "https://")
+	return strings.TrimSuffix(host, "/")
+}
+
+// mirrorScheme returns the scheme the registry mirror is accessed with
+func mirrorScheme() string {
+	if strings.HasPrefix(registryMirror, "http://") {
+		return "http"
+	}
+
+	return "https"
+}
+
+// mirroredImageName returns the name an image is pulled and used with,
+// which differs from the manifest's name if a registry mirror is set
+func mirroredImageName(name string) string {
+	if registryMirror == "" || !strings.HasPrefix(name, "quay.io/") {
+		return name
+	}
+
+	return mirrorHost() + "/" + strings.TrimPrefix(name, "quay.io/")
+}
+
+// imageReferenceRegexp matches the image references in the unit templates
+var imageReferenceRegexp = regexp.MustCompile(`quay.io/[a-z]*/[a-z0-9\-]*`)
+
+// mirrorImageReferences rewrites the image references in a rendered unit
+func mirrorImageReferences(data []byte) []byte {
+	return imageReferenceRegexp.ReplaceAllFunc(data, func(ref []byte) []byte {
+		return []byte(mirroredImageName(string(ref)))
+	})
+}
+
+// registryHost returns the registry an image is pulled from, following the
+// rules of the Docker client: the first component of the name is a host
+// if it contains a dot or a port, or is 'localhost'.
+func registryHost(repository string) string {
+	i := strings.Index(repository, "/")
+	if i < 0 {
+		return dockerHubRegistry
+	}
+
+	first := repository[:i]
+	if strings.ContainsAny(first, ".:") || first == "localhost" {
+		return first
+	}
+
+	return dockerHubRegistry
+}
+
+// dockerConfigFile is the part of the Docker client config we use
+type dockerConfigFile struct {
+	Auths map[string]struct {
+		Auth  string `json:"auth"`
+		Email string `json:"email"`
+	} `json:"auths"`
+	CredHelpers map[string]string `json:"credHelpers"`
+	CredsStore  string            `json:"credsStore"`
+}
+
+// credentialHelperResponse is written by 'docker-credential-* get'
+type credentialHelperResponse struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+// readDockerConfig parses the Docker client config, a missing file
+// is treated like an empty one
+func readDockerConfig(r io.Reader) (*dockerConfigFile, error) {
+	var config dockerConfigFile
+	if r == nil {
+		f, err := os.Open(dockerConfigPath)
+		if os.IsNotExist(err) {
+			return &config, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	err := json.NewDecoder(r).Decode(&config)
+	if err != nil {
+		return nil, fmt.Errorf("readDockerConfig: %s", err.Error())
+	}
+
+	return &config, nil
+}
+
+// registryKeys are the keys a registry can have in the 'auths' section
+func registryKeys(host string) []string {
+	if host == dockerHubRegistry {
+		return []string{"https://index.docker.io/v1/", "index.docker.io", "docker.io"}
+	}
+
+	return []string{host, "https://" + host, "http://" + host, "https://" + host + "/v1/", "https://" + host + "/v2/"}
+}
+
+// runCredentialHelper asks a credential helper for the credentials of a registry
+func runCredentialHelper(helper, host string) (*docker.AuthConfiguration, error) {
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(host)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		// helpers report unknown registries on stdout and exit with an error
+		message := strings.TrimSpace(string(output) + stderr.String())
+		if strings.Contains(message, "credentials not found") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("credential helper '%s': %s: %s", helper, err.Error(), message)
+	}
+
+	var response credentialHelperResponse
+	err = json.Unmarshal(output, &response)
+	if err != nil {
+		return nil, fmt.Errorf("credential helper '%s': %s", helper, err.Error())
+	}
+
+	if response.Username == "<token>" {
+		log.Printf("Credential helper '%s' returned an identity token for '%s', which isn't supported\n", helper, host)
+		return nil, nil
+	}
+
+	return &docker.AuthConfiguration{
+		Username:      response.Username,
+		Password:      response.Secret,
+		ServerAddress: host,
+	}, nil
+}
+
+// credentials returns the credentials for a registry host, or nil if there
+// are none, in which case the image is pulled anonymously
+func (c *dockerConfigFile) credentials(host string) (*docker.AuthConfiguration, error) {
+	if helper, ok := c.CredHelpers[host]; ok {
+		return runCredentialHelper(helper, host)
+	}
+
+	for _, key := range registryKeys(host) {
+		entry, ok := c.Auths[key]
+		if !ok || entry.Auth == "" {
+			continue
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			return nil, fmt.Errorf("credentials for '%s': %s", key, err.Error())
+		}
+
+		userAndPassword := strings.SplitN(string(decoded), ":", 2)
+		if len(userAndPassword) != 2 {
+			return nil, fmt.Errorf("credentials for '%s' are malformed", key)
+		}
+
+		return &docker.AuthConfiguration{
+			Username:      userAndPassword[0],
+			Password:      userAndPassword[1],
+			Email:         entry.Email,
+			ServerAddress: host,
+		}, nil
+	}
+
+	if c.CredsStore != "" {
+		return runCredentialHelper(c.CredsStore, host)
+	}
+
+	return nil, nil
+}
+
+// registryAuth returns the credentials used to pull the given repository,
+// read from authCfg or, if it's nil, from the Docker client config. Without
+// usable credentials the image is pulled anonymously, which works for
+// public images.
+func registryAuth(repository string, authCfg io.Reader) docker.AuthConfiguration {
+	host := registryHost(repository)
+
+	config, err := readDockerConfig(authCfg)
+	if err != nil {
+		log.Printf("WARNING: pulling '%s' anonymously: %s\n", repository, err.Error())
+		return docker.AuthConfiguration{}
+	}
+
+	auth, err := config.credentials(host)
+	if err != nil {
+		log.Printf("WARNING: pulling '%s' anonymously: %s\n", repository, err.Error())
+		return docker.AuthConfiguration{}
+	}
+
+	if auth == nil {
+		return docker.AuthConfiguration{}
+	}
+
+	return *auth
+}
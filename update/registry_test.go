@@ -0,0 +1,96 @@
+package update
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryHost(t *testing.T) {
+	assert.Equal(t, "quay.io", registryHost("quay.io/experimentalplatform/configure"))
+	assert.Equal(t, "mirror:5000", registryHost("mirror:5000/experimentalplatform/configure"))
+	assert.Equal(t, "localhost", registryHost("localhost/foo"))
+	assert.Equal(t, "docker.io", registryHost("library/busybox"))
+	assert.Equal(t, "docker.io", registryHost("busybox"))
+}
+
+func TestRegistryAuth(t *testing.T) {
+	config := `{
+		"auths": {
+			"quay.io": {"auth": "Zm9vOmJhcg==", "email": "foo@example.com"},
+			"https://index.docker.io/v1/": {"auth": "aHViOnNlY3JldA=="}
+		}
+	}`
+
+	auth := registryAuth("quay.io/protonet/dummy", strings.NewReader(config))
+	assert.Equal(t, docker.AuthConfiguration{Username: "foo", Password: "bar", Email: "foo@example.com", ServerAddress: "quay.io"}, auth)
+
+	auth = registryAuth("library/busybox", strings.NewReader(config))
+	assert.Equal(t, "hub", auth.Username)
+	assert.Equal(t, "secret", auth.Password)
+
+	// no credentials, pulled anonymously
+	auth = registryAuth("registry.example.com/foo/bar", strings.NewReader(config))
+	assert.Equal(t, docker.AuthConfiguration{}, auth)
+
+	// a missing config file isn't an error either
+	defer func(p string) { dockerConfigPath = p }(dockerConfigPath)
+	dockerConfigPath = "/nonexistent/config.json"
+	auth = registryAuth("quay.io/protonet/dummy", nil)
+	assert.Equal(t, docker.AuthConfiguration{}, auth)
+}
+
+func TestRegistryAuthCredentialHelper(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "platconf-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	helper := `#!/bin/sh
+read host
+if [ "$host" = "quay.io" ]; then
+	echo '{"ServerURL": "quay.io", "Username": "robot", "Secret": "s3cr3t"}'
+else
+	echo 'credentials not found in native keychain'
+	exit 1
+fi
+`
+	err = ioutil.WriteFile(path.Join(tempDir, "docker-credential-test"), []byte(helper), 0755)
+	assert.Nil(t, err)
+
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", tempDir+":"+os.Getenv("PATH"))
+
+	config := `{"credHelpers": {"quay.io": "test"}, "credsStore": "test"}`
+	auth := registryAuth("quay.io/protonet/dummy", strings.NewReader(config))
+	assert.Equal(t, docker.AuthConfiguration{Username: "robot", Password: "s3cr3t", ServerAddress: "quay.io"}, auth)
+
+	auth = registryAuth("registry.example.com/foo/bar", strings.NewReader(config))
+	assert.Equal(t, docker.AuthConfiguration{}, auth)
+
+	// a broken helper falls back to an anonymous pull
+	config = `{"credHelpers": {"quay.io": "nonexistent"}}`
+	auth = registryAuth("quay.io/protonet/dummy", strings.NewReader(config))
+	assert.Equal(t, docker.AuthConfiguration{}, auth)
+}
+
+func TestRegistryMirror(t *testing.T) {
+	assert.Equal(t, "quay.io/experimentalplatform/configure", mirroredImageName("quay.io/experimentalplatform/configure"))
+
+	defer func() { registryMirror = "" }()
+	registryMirror = "mirror.local:5000"
+
+	assert.Equal(t, "mirror.local:5000/experimentalplatform/configure", mirroredImageName("quay.io/experimentalplatform/configure"))
+	assert.Equal(t, "docker.io/library/busybox", mirroredImageName("docker.io/library/busybox"))
+
+	unit := "ExecStart=/usr/bin/docker run --name=foo quay.io/experimentalplatform/foo:v1\n"
+	assert.Equal(t, "ExecStart=/usr/bin/docker run --name=foo mirror.local:5000/experimentalplatform/foo:v1\n", string(mirrorImageReferences([]byte(unit))))
+
+	// the scheme of a plain HTTP mirror isn't part of the image names
+	registryMirror = "http://mirror.local:5000/"
+	assert.Equal(t, "mirror.local:5000/experimentalplatform/configure", mirroredImageName("quay.io/experimentalplatform/configure"))
+}
@@ -0,0 +1,161 @@
+package update
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// dockerHubEndpoint is the registry API of image names without a host
+const dockerHubEndpoint = "registry-1.docker.io"
+
+// registryProxyChunk is the amount of data sent between two checks of the limiter
+const registryProxyChunk = 32 << 10
+
+// hopHeaders are only meaningful for a single connection and aren't forwarded
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// registryProxy forwards the registry API on localhost to a registry and
+// sends the responses at a limited rate. The daemon downloads the layers
+// itself, so pulling through the proxy is what limits the bandwidth used.
+// Docker talks plain HTTP to registries on 127.0.0.0/8 without further
+// configuration, the registry itself is reached over HTTPS.
+type registryProxy struct {
+	upstream *url.URL
+	limiter  *rateLimiter
+	client   *http.Client
+
+	listener net.Listener
+	server   *http.Server
+}
+
+// startRegistryProxy starts a proxy to upstream on a free port of 127.0.0.1
+func startRegistryProxy(upstream *url.URL, limiter *rateLimiter, client *http.Client) (*registryProxy, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("startRegistryProxy: %s", err.Error())
+	}
+
+	p := &registryProxy{
+		upstream: upstream,
+		limiter:  limiter,
+		client:   client,
+		listener: listener,
+	}
+	// the blob requests are redirected to a CDN by some registries, the
+	// client follows the redirects so the blobs are limited as well
+	p.server = &http.Server{Handler: p}
+	go p.server.Serve(listener)
+
+	return p, nil
+}
+
+// Host is the registry host the images are pulled from through the proxy
+func (p *registryProxy) Host() string {
+	return p.listener.Addr().String()
+}
+
+// Close stops the proxy
+func (p *registryProxy) Close() error {
+	return p.listener.Close()
+}
+
+func (p *registryProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target := *p.upstream
+	target.Path = r.URL.Path
+	target.RawQuery = r.URL.RawQuery
+
+	req, err := http.NewRequest(r.Method, target.String(), r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	req = req.WithContext(r.Context())
+	copyHeaders(req.Header, r.Header)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	copyHeaders(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+
+	buffer := make([]byte, registryProxyChunk)
+	for {
+		n, err := resp.Body.Read(buffer)
+		if n > 0 {
+			if p.limiter.wait(r.Context(), int64(n)) != nil {
+				return
+			}
+			if _, werr := w.Write(buffer[:n]); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func copyHeaders(dst, src http.Header) {
+	for name, values := range src {
+		dst[name] = append([]string(nil), values...)
+	}
+
+	for _, name := range hopHeaders {
+		dst.Del(name)
+	}
+}
+
+// proxiedRepository splits an image name into the registry endpoint and the
+// repository's path on it, following the rules of registryHost. Registries
+// are accessed with HTTPS, except for a plain HTTP registry mirror.
+func proxiedRepository(repository string) (*url.URL, string) {
+	host := registryHost(repository)
+	if host == dockerHubRegistry {
+		name := repository
+		if strings.HasPrefix(name, dockerHubRegistry+"/") {
+			name = strings.TrimPrefix(name, dockerHubRegistry+"/")
+		}
+		if !strings.Contains(name, "/") {
+			name = "library/" + name
+		}
+		return &url.URL{Scheme: "https", Host: dockerHubEndpoint}, name
+	}
+
+	scheme := "https"
+	if registryMirror != "" && host == mirrorHost() {
+		scheme = mirrorScheme()
+	}
+
+	return &url.URL{Scheme: scheme, Host: host}, strings.TrimPrefix(repository, host+"/")
+}
+
+// newRegistryProxyClient returns the client the proxy uses for the registry
+func newRegistryProxyClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			Dial: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).Dial,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+}
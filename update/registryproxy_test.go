@@ -0,0 +1,124 @@
+package update
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxiedRepository(t *testing.T) {
+	upstream, name := proxiedRepository("quay.io/experimentalplatform/app")
+	assert.Equal(t, "https://quay.io", upstream.String())
+	assert.Equal(t, "experimentalplatform/app", name)
+
+	upstream, name = proxiedRepository("mirror.local:5000/experimentalplatform/app")
+	assert.Equal(t, "https://mirror.local:5000", upstream.String())
+	assert.Equal(t, "experimentalplatform/app", name)
+
+	upstream, name = proxiedRepository("busybox")
+	assert.Equal(t, "https://registry-1.docker.io", upstream.String())
+	assert.Equal(t, "library/busybox", name)
+
+	_, name = proxiedRepository("docker.io/protonet/dummy")
+	assert.Equal(t, "protonet/dummy", name)
+
+	defer func() { registryMirror = "" }()
+	registryMirror = "http://mirror.local:5000"
+	upstream, name = proxiedRepository(mirroredImageName("quay.io/experimentalplatform/app"))
+	assert.Equal(t, "http://mirror.local:5000", upstream.String())
+	assert.Equal(t, "experimentalplatform/app", name)
+
+	upstream, _ = proxiedRepository("quay.io/experimentalplatform/app")
+	assert.Equal(t, "https://quay.io", upstream.String())
+}
+
+func TestRegistryProxy(t *testing.T) {
+	blob := bytes.Repeat([]byte("x"), 50<<10)
+
+	cdn := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(blob)
+	}))
+	defer cdn.Close()
+
+	registry := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/":
+			w.Header().Set("WWW-Authenticate", `Bearer realm="https://auth.example.com/token"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		case "/v2/experimentalplatform/app/blobs/sha256:abc":
+			if r.Header.Get("Authorization") != "Bearer token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			http.Redirect(w, r, cdn.URL+"/blob?signature=foo", http.StatusTemporaryRedirect)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer registry.Close()
+
+	upstream, err := url.Parse(registry.URL)
+	assert.Nil(t, err)
+	// both test servers use the same self-signed certificate
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	proxy, err := startRegistryProxy(upstream, newRateLimiter(100<<10), client)
+	assert.Nil(t, err)
+	defer proxy.Close()
+
+	// the authentication challenge is passed on
+	resp, err := http.Get("http://" + proxy.Host() + "/v2/")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, `Bearer realm="https://auth.example.com/token"`, resp.Header.Get("WWW-Authenticate"))
+
+	// the blob is fetched from the CDN by the proxy, at the limited rate
+	req, err := http.NewRequest("GET", "http://"+proxy.Host()+"/v2/experimentalplatform/app/blobs/sha256:abc", nil)
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer token")
+
+	start := time.Now()
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, blob, data)
+	assert.True(t, time.Since(start) >= 400*time.Millisecond, time.Since(start).String())
+}
+
+func TestRegistryProxyHTTPMirror(t *testing.T) {
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/experimentalplatform/app/manifests/v1" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("manifest"))
+	}))
+	defer mirror.Close()
+
+	defer func() { registryMirror = "" }()
+	registryMirror = mirror.URL
+
+	upstream, name := proxiedRepository(mirroredImageName("quay.io/experimentalplatform/app"))
+	assert.Equal(t, "experimentalplatform/app", name)
+	proxy, err := startRegistryProxy(upstream, newRateLimiter(100<<10), newRegistryProxyClient())
+	assert.Nil(t, err)
+	defer proxy.Close()
+
+	resp, err := http.Get("http://" + proxy.Host() + "/v2/" + name + "/manifests/v1")
+	assert.Nil(t, err)
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "manifest", string(data))
+}
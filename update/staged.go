@@ -0,0 +1,177 @@
+package update
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"github.com/experimental-platform/platconf/platconf"
+)
+
+// stagedInfoName is the file describing the staged release
+const stagedInfoName = "staged.json"
+
+// stagedRelease describes a release downloaded by 'update --download-only'
+type stagedRelease struct {
+	Build         int32     `json:"build"`
+	Channel       string    `json:"channel"`
+	ChannelSource string    `json:"channel_source"`
+	StagedAt      time.Time `json:"staged_at"`
+	// InstalledBuild is the build installed while staging, 0 if there was none
+	InstalledBuild int32 `json:"installed_build"`
+}
+
+func stagedReleaseDir(rootDir string) string {
+	return path.Join(rootDir, dataDir, "staged")
+}
+
+// stageRelease stores the rendered configure directory of a release whose
+// images have been pulled, so 'update --apply-staged' can install it
+func stageRelease(rootDir, channel string, source channelSource, configureDir string, manifest *platconf.ReleaseManifestV2) error {
+	installedBuild, err := readInstalledBuild(rootDir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("stageRelease: reading the installed release number: %s", err.Error())
+	}
+
+	info, err := json.Marshal(stagedRelease{
+		Build:          manifest.Build,
+		Channel:        channel,
+		ChannelSource:  source.String(),
+		StagedAt:       time.Now().UTC(),
+		InstalledBuild: installedBuild,
+	})
+	if err != nil {
+		return err
+	}
+
+	targetDir := stagedReleaseDir(rootDir)
+	log.Printf("Staging build %d in '%s'\n", manifest.Build, targetDir)
+
+	err = storeRelease(targetDir, configureDir, manifest, map[string][]byte{stagedInfoName: info})
+	if err != nil {
+		return fmt.Errorf("stageRelease: %s", err.Error())
+	}
+
+	return nil
+}
+
+// readStagedRelease returns the staged release and its manifest
+func readStagedRelease(rootDir string) (*stagedRelease, *platconf.ReleaseManifestV2, error) {
+	dir := stagedReleaseDir(rootDir)
+
+	data, err := ioutil.ReadFile(path.Join(dir, stagedInfoName))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var staged stagedRelease
+	err = json.Unmarshal(data, &staged)
+	if err != nil {
+		return nil, nil, fmt.Errorf("readStagedRelease: %s", err.Error())
+	}
+
+	data, err = ioutil.ReadFile(path.Join(dir, "manifest.json"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var manifest platconf.ReleaseManifestV2
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("readStagedRelease: %s", err.Error())
+	}
+
+	if manifest.Build != staged.Build {
+		return nil, nil, fmt.Errorf("readStagedRelease: the staged manifest is for build %d instead of %d", manifest.Build, staged.Build)
+	}
+
+	return &staged, &manifest, nil
+}
+
+func removeStagedRelease(rootDir string) error {
+	return os.RemoveAll(stagedReleaseDir(rootDir))
+}
+
+// checkStagedRelease makes sure the staged release is still the one the
+// channel would install. The manifest is checked again if it can be fetched,
+// since the point of staging is that applying works without a download.
+func checkStagedRelease(ctx context.Context, o *Opts, rootDir string, staged *stagedRelease, manifest *platconf.ReleaseManifestV2) error {
+	channel, source := getChannel(o.Channel)
+	if channel != staged.Channel {
+		return fmt.Errorf("the channel changed from '%s' to '%s' since build %d was staged", staged.Channel, channel, staged.Build)
+	}
+
+	// falling back to the default channel on one side only means the channel
+	// file couldn't be read, which matching names don't make up for
+	stagedDefault := staged.ChannelSource == csDefault.String()
+	if staged.ChannelSource != "" && stagedDefault != (source == csDefault) {
+		return fmt.Errorf("build %d was staged for channel '%s' from the %s, but it's taken from the %s now", staged.Build, staged.Channel, staged.ChannelSource, source)
+	}
+
+	installedBuild, err := readInstalledBuild(rootDir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("reading the installed release number: %s", err.Error())
+	}
+	if installedBuild != staged.InstalledBuild {
+		return fmt.Errorf("the staged build %d is stale, build %d has been installed since", staged.Build, installedBuild)
+	}
+
+	for _, img := range manifest.Images {
+		exists, err := imageExists(img.Name, img.Tag)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("the staged build %d is stale, image '%s:%s' has been removed", staged.Build, img.Name, img.Tag)
+		}
+	}
+
+	if o.Force {
+		return nil
+	}
+
+	manifestCtx, cancel := phaseContext(ctx, o.ManifestTimeout)
+	latest, err := fetchReleaseData(manifestCtx, channel)
+	cancel()
+	if err != nil {
+		log.Printf("WARNING: couldn't check whether the staged build is the latest one: %s\n", err.Error())
+		return nil
+	}
+	if latest.Build != staged.Build {
+		return fmt.Errorf("the staged build %d is stale, build %d has been released on channel '%s' since. Use --force to install it anyway", staged.Build, latest.Build, channel)
+	}
+
+	return nil
+}
+
+// prepareStagedRelease returns the staged release in the form prepareRelease() does
+func prepareStagedRelease(ctx context.Context, o *Opts, rootDir string) (*platconf.ReleaseManifestV2, string, string, error) {
+	staged, manifest, err := readStagedRelease(rootDir)
+	if os.IsNotExist(err) {
+		return nil, "", "", fmt.Errorf("there is no staged release, use 'platconf update --download-only' first")
+	}
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	err = checkStagedRelease(ctx, o, rootDir, staged, manifest)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	if !o.SkipPreflight {
+		// the images have been pulled already, so the manifest isn't needed
+		err = preflight(ctx, rootDir, nil, 0)
+		if err != nil {
+			return nil, "", "", err
+		}
+	}
+
+	log.Printf("Installing the staged build %d of channel '%s', staged at %s\n", staged.Build, staged.Channel, staged.StagedAt.Format(time.RFC3339))
+	return manifest, staged.Channel, path.Join(stagedReleaseDir(rootDir), "configure"), nil
+}
@@ -0,0 +1,70 @@
+package update
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/experimental-platform/platconf/platconf"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStageRelease(t *testing.T) {
+	tempRootDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempRootDir)
+	fakeConfigureDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(fakeConfigureDir)
+
+	assert.Nil(t, os.MkdirAll(path.Join(fakeConfigureDir, "services"), 0755))
+	assert.Nil(t, ioutil.WriteFile(path.Join(fakeConfigureDir, "services/foo.service"), []byte("foo"), 0644))
+	assert.Nil(t, os.MkdirAll(path.Join(tempRootDir, "etc/protonet/system"), 0755))
+	assert.Nil(t, ioutil.WriteFile(path.Join(tempRootDir, "etc/protonet/system/release_number"), []byte("100"), 0644))
+
+	_, _, err = readStagedRelease(tempRootDir)
+	assert.True(t, os.IsNotExist(err))
+
+	err = stageRelease(tempRootDir, "beta", csCommandLine, fakeConfigureDir, &platconf.ReleaseManifestV2{Build: 200, Codename: "test"})
+	assert.Nil(t, err)
+
+	staged, manifest, err := readStagedRelease(tempRootDir)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 200, staged.Build)
+	assert.EqualValues(t, 100, staged.InstalledBuild)
+	assert.Equal(t, "beta", staged.Channel)
+	assert.Equal(t, "command line", staged.ChannelSource)
+	assert.Equal(t, "test", manifest.Codename)
+
+	data, err := ioutil.ReadFile(path.Join(stagedReleaseDir(tempRootDir), "configure/services/foo.service"))
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", string(data))
+
+	// --force skips the manifest check, there are no images to look for
+	o := &Opts{Channel: "beta", Force: true}
+	assert.Nil(t, checkStagedRelease(context.Background(), o, tempRootDir, staged, manifest))
+
+	o.Channel = "stable"
+	assert.NotNil(t, checkStagedRelease(context.Background(), o, tempRootDir, staged, manifest))
+
+	// the same channel, but only because the channel file can't be read
+	defer func(c, p string) { defaultChannel, channelFilePath = c, p }(defaultChannel, channelFilePath)
+	defaultChannel = "beta"
+	channelFilePath = "/this/file/should/not/exist.txt"
+	o.Channel = ""
+	assert.NotNil(t, checkStagedRelease(context.Background(), o, tempRootDir, staged, manifest))
+
+	channelFilePath = path.Join(tempRootDir, "channel")
+	assert.Nil(t, ioutil.WriteFile(channelFilePath, []byte("beta"), 0644))
+	assert.Nil(t, checkStagedRelease(context.Background(), o, tempRootDir, staged, manifest))
+
+	o.Channel = "beta"
+	assert.Nil(t, ioutil.WriteFile(path.Join(tempRootDir, "etc/protonet/system/release_number"), []byte("150"), 0644))
+	assert.NotNil(t, checkStagedRelease(context.Background(), o, tempRootDir, staged, manifest))
+
+	assert.Nil(t, removeStagedRelease(tempRootDir))
+	_, _, err = readStagedRelease(tempRootDir)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -17,6 +17,9 @@ type statusData struct {
 }
 
 func setStatus(status string, progress *float32, what *string) error {
+	setLockPhase(status)
+	showButtonPhase(status)
+
 	fakeDial := func(proto, addr string) (conn net.Conn, err error) {
 		return net.Dial("unix", statusSocketPath)
 	}
@@ -0,0 +1,206 @@
+package update
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/experimental-platform/platconf/platconf"
+)
+
+// StatusOpts contains command line parameters for the 'status' command
+type StatusOpts struct {
+	JSON            bool          `long:"json" description:"Print the status as JSON"`
+	ManifestTimeout time.Duration `long:"manifest-timeout" description:"Timeout for fetching the release manifest, 0 disables it" default:"2m"`
+	SystemdTimeout  time.Duration `long:"systemd-timeout" description:"Timeout for querying the systemd units, 0 disables it" default:"5m"`
+
+	PlatconfVersion string           `no-flag:"true"`
+	Config          *platconf.Config `no-flag:"true"`
+}
+
+type imageStatus struct {
+	Name    string `json:"name"`
+	Tag     string `json:"tag"`
+	Present bool   `json:"present"`
+	Error   string `json:"error,omitempty"`
+}
+
+type unitStatus struct {
+	Name        string `json:"name"`
+	Enabled     bool   `json:"enabled"`
+	Active      bool   `json:"active"`
+	EnableState string `json:"enable_state"`
+	ActiveState string `json:"active_state"`
+	Error       string `json:"error,omitempty"`
+}
+
+// statusReport describes the installed release and the state of its parts
+type statusReport struct {
+	Build           *int32        `json:"build"`
+	Codename        string        `json:"codename"`
+	ReleaseNotesURL string        `json:"release_notes_url"`
+	Channel         string        `json:"channel"`
+	ChannelSource   string        `json:"channel_source"`
+	PlatconfVersion string        `json:"platconf_version"`
+	Images          []imageStatus `json:"images"`
+	Units           []unitStatus  `json:"units"`
+	LatestBuild     *int32        `json:"latest_build"`
+	UpdateAvailable *bool         `json:"update_available"`
+	StagedBuild     *int32        `json:"staged_build"`
+	Errors          []string      `json:"errors"`
+}
+
+func collectStatus(ctx context.Context, o *StatusOpts, rootDir string) *statusReport {
+	report := statusReport{
+		PlatconfVersion: o.PlatconfVersion,
+		Images:          []imageStatus{},
+		Units:           []unitStatus{},
+		Errors:          []string{},
+	}
+
+	channel, source := getChannel("")
+	report.Channel = channel
+	report.ChannelSource = source.String()
+
+	release, err := readInstalledRelease(rootDir)
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("reading the installed release: %s", err.Error()))
+	} else {
+		report.Build = &release.Build
+		report.Codename = release.Codename
+		report.ReleaseNotesURL = release.ReleaseNotesURL
+	}
+
+	manifest, err := readInstalledManifest(rootDir)
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("reading the installed manifest: %s", err.Error()))
+	} else {
+		for _, img := range manifest.Images {
+			status := imageStatus{Name: img.Name, Tag: img.Tag}
+			status.Present, err = imageExists(img.Name, img.Tag)
+			if err != nil {
+				status.Error = err.Error()
+			}
+			report.Images = append(report.Images, status)
+		}
+	}
+
+	units, err := listPlatformUnits(path.Join(rootDir, "etc/systemd/system"))
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("listing the platform units: %s", err.Error()))
+	}
+	systemdCtx, cancel := phaseContext(ctx, o.SystemdTimeout)
+	defer cancel()
+	for _, u := range units {
+		status := unitStatus{Name: u}
+		status.EnableState, err = systemdGetUnitFileState(systemdCtx, u)
+		if err != nil {
+			status.Error = err.Error()
+			report.Units = append(report.Units, status)
+			continue
+		}
+		status.ActiveState, err = systemdGetUnitActiveState(systemdCtx, u)
+		if err != nil {
+			status.Error = err.Error()
+		}
+		status.Enabled = status.EnableState == "enabled"
+		status.Active = status.ActiveState == "active"
+		report.Units = append(report.Units, status)
+	}
+
+	manifestCtx, cancel := phaseContext(ctx, o.ManifestTimeout)
+	defer cancel()
+	latest, err := fetchReleaseData(manifestCtx, channel)
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("fetching the manifest: %s", err.Error()))
+	} else {
+		report.LatestBuild = &latest.Build
+		if report.Build != nil {
+			available := latest.Build != *report.Build
+			report.UpdateAvailable = &available
+		}
+	}
+
+	staged, _, err := readStagedRelease(rootDir)
+	if err == nil {
+		report.StagedBuild = &staged.Build
+	} else if !os.IsNotExist(err) {
+		report.Errors = append(report.Errors, fmt.Sprintf("reading the staged release: %s", err.Error()))
+	}
+
+	return &report
+}
+
+func printStatus(report *statusReport) {
+	if report.Build != nil {
+		fmt.Printf("Installed build:  %d (%s)\n", *report.Build, report.Codename)
+	} else {
+		fmt.Println("Installed build:  unknown")
+	}
+	fmt.Printf("Channel:          %s (%s)\n", report.Channel, report.ChannelSource)
+	if report.PlatconfVersion != "" {
+		fmt.Printf("Platconf version: %s\n", report.PlatconfVersion)
+	} else {
+		fmt.Println("Platconf version: development binary")
+	}
+
+	switch {
+	case report.UpdateAvailable == nil:
+		fmt.Println("Update available: unknown")
+	case *report.UpdateAvailable:
+		fmt.Printf("Update available: yes, build %d\n", *report.LatestBuild)
+	default:
+		fmt.Println("Update available: no")
+	}
+	if report.StagedBuild != nil {
+		fmt.Printf("Staged build:     %d\n", *report.StagedBuild)
+	}
+
+	fmt.Println("Images:")
+	for _, img := range report.Images {
+		switch {
+		case img.Error != "":
+			fmt.Printf("\t%s:%s: %s\n", img.Name, img.Tag, img.Error)
+		case img.Present:
+			fmt.Printf("\t%s:%s: present\n", img.Name, img.Tag)
+		default:
+			fmt.Printf("\t%s:%s: MISSING\n", img.Name, img.Tag)
+		}
+	}
+
+	fmt.Println("Units:")
+	for _, u := range report.Units {
+		if u.Error != "" {
+			fmt.Printf("\t%s: %s\n", u.Name, u.Error)
+		} else {
+			fmt.Printf("\t%s: %s, %s\n", u.Name, u.EnableState, u.ActiveState)
+		}
+	}
+
+	for _, e := range report.Errors {
+		fmt.Printf("ERROR: %s\n", e)
+	}
+}
+
+// Execute is the function ran when the 'status' command is used
+func (o *StatusOpts) Execute(args []string) error {
+	os.Setenv("DOCKER_API_VERSION", "1.22")
+	applyConfig(o.Config)
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	report := collectStatus(ctx, o, "/")
+
+	if o.JSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+
+	printStatus(report)
+	return nil
+}
@@ -0,0 +1,43 @@
+package update
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/experimental-platform/platconf/platconf"
+)
+
+// UnlockOpts contains command line parameters for the 'unlock' command
+type UnlockOpts struct {
+	Force bool `short:"f" long:"force" description:"Remove the lock even if the process holding it is still running"`
+
+	Config *platconf.Config `no-flag:"true"`
+}
+
+// Execute is the function ran when the 'unlock' command is used
+func (o *UnlockOpts) Execute(args []string) error {
+	applyConfig(o.Config)
+
+	if _, err := os.Stat(lockfilePath); err == nil {
+		fmt.Printf("The update lock is held by %s\n", describeLockHolder(lockfilePath))
+	}
+
+	platconf.RequireRoot()
+	removed, err := unlock(lockfilePath, o.Force)
+	if err == errLockHeld {
+		fmt.Fprintln(os.Stderr, "The process holding the lock is still running, use --force to remove the lock anyway.")
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to remove the lock: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	if removed {
+		fmt.Println("The update lock has been removed.")
+	} else {
+		fmt.Println("The update lock isn't held.")
+	}
+
+	return nil
+}
@@ -1,6 +1,7 @@
 package update
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,19 +11,71 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"time"
 
 	"github.com/experimental-platform/platconf/platconf"
-	"github.com/nightlyone/lockfile"
 )
 
 var lockfilePath = "/var/run/platconf.lock"
 
+var manifestURLv2 = "https://raw.githubusercontent.com/protonet/builds/master/manifest-v2/%s.json"
+var manifestURLv1 = "https://raw.githubusercontent.com/protonet/builds/master/%s.json"
+var channelListURL = "https://api.github.com/repos/protonet/builds/contents/manifest-v2"
+var dataDir = "/var/lib/platconf"
+
 // Opts contains command line parameters for the 'update' command
 type Opts struct {
-	Channel     string `short:"c" long:"channel" description:"Channel to be installed"`
-	Pullers     int    `short:"p" long:"pullers" description:"Maximum images being pulled at once" default:"4"`
-	PullRetries int    `short:"r" long:"pull-retries" description:"Maximum number of attempts to pull an image" default:"5"`
-	//Force bool `short:"f" long:"force" description:"Force installing the current latest release"`
+	Channel string `short:"c" long:"channel" description:"Channel to be installed. With --bundle the channel file is only changed if this is set"`
+	Check   bool   `long:"check" description:"Only check whether an update is available. Exits with 0 if up-to-date, 2 if an update is available and 1 on error"`
+	Force   bool   `short:"f" long:"force" description:"Force installing the current latest release"`
+	Reapply bool   `long:"reapply" description:"Reinstall the files of the current latest release without rebooting"`
+	Bundle  string `long:"bundle" description:"Install the release from an offline bundle created with 'platconf bundle create'"`
+
+	DownloadOnly bool `long:"download-only" description:"Download the release and stage it without installing it"`
+	ApplyStaged  bool `long:"apply-staged" description:"Install the release staged with --download-only"`
+
+	SkipPreflight bool `long:"skip-preflight" description:"Don't abort the update if the pre-flight checks fail"`
+
+	DownloadRate   string `long:"download-rate" description:"Limit the image downloads to this many bytes per second, with an optional K, M or G suffix"`
+	DownloadWindow string `long:"download-window" description:"Only download images during this daily time window in local time, e.g. '22:00-06:00'. The pull timeout doesn't apply then"`
+
+	ManifestTimeout time.Duration `long:"manifest-timeout" description:"Timeout for fetching the release manifest, 0 disables it" default:"2m"`
+	ExtractTimeout  time.Duration `long:"extract-timeout" description:"Timeout for pulling and extracting the configure image, 0 disables it" default:"30m"`
+	OSUpdateTimeout time.Duration `long:"os-update-timeout" description:"Timeout for the OS update, 0 disables it" default:"30m"`
+	SystemdTimeout  time.Duration `long:"systemd-timeout" description:"Timeout for setting up the systemd units, 0 disables it" default:"5m"`
+
+	PullOpts
+
+	Config *platconf.Config `no-flag:"true"`
+}
+
+// PullOpts contains the command line parameters for pulling the images of a
+// release, shared by the commands which do so
+type PullOpts struct {
+	Pullers     int           `short:"p" long:"pullers" description:"Maximum images being pulled at once" default:"4"`
+	PullRetries int           `short:"r" long:"pull-retries" description:"Maximum number of attempts to pull an image" default:"5"`
+	PullTimeout time.Duration `long:"pull-timeout" description:"Timeout for pulling all images, 0 disables it" default:"2h"`
+}
+
+// applyConfig points the package-wide paths and URLs at the configured values
+func applyConfig(c *platconf.Config) {
+	if c == nil {
+		return
+	}
+
+	lockfilePath = c.LockFile
+	channelFilePath = c.ChannelFile
+	defaultChannel = c.DefaultChannel
+	statusSocketPath = c.StatusSocket
+	dockerConfigPath = c.DockerConfig
+	manifestURLv2 = c.ManifestURL
+	manifestURLv1 = c.ManifestURLv1
+	channelListURL = c.ChannelListURL
+	extractMethod = c.ExtractMethod
+	registryMirror = c.RegistryMirror
+	dataDir = c.DataDir
+	platconfBinary = c.SelfupdateTarget
+	setupButton(c.ButtonDriver, c.ButtonDevice, c.ButtonPhases)
 }
 
 // Execute is the function ran when the 'update' command is used
@@ -33,48 +86,100 @@ func (o *Opts) Execute(args []string) error {
 		return errors.New("The maximum number of pullers must be > 0")
 	}
 
+	if o.Force && o.Reapply {
+		return errors.New("--force and --reapply are mutually exclusive")
+	}
+
+	if o.Check && o.Bundle != "" {
+		return errors.New("--check and --bundle are mutually exclusive")
+	}
+
+	if o.DownloadOnly && (o.ApplyStaged || o.Check || o.Reapply || o.Bundle != "") {
+		return errors.New("--download-only can't be combined with --apply-staged, --check, --reapply or --bundle")
+	}
+
+	if o.ApplyStaged && (o.Check || o.Reapply || o.Bundle != "") {
+		return errors.New("--apply-staged can't be combined with --check, --reapply or --bundle")
+	}
+
+	_, err := newDownloadSchedule(o.DownloadRate, o.DownloadWindow)
+	if err != nil {
+		return err
+	}
+
+	applyConfig(o.Config)
+
+	if o.Check {
+		ctx, cancel := signalContext()
+		manifestCtx, cancelManifest := phaseContext(ctx, o.ManifestTimeout)
+		code := runCheck(manifestCtx, o.Channel, "/")
+		cancelManifest()
+		cancel()
+		os.Exit(code)
+	}
+
 	platconf.RequireRoot()
 	lock := tryLockUpdate(lockfilePath)
 	defer lock.Unlock()
+	// a failed update keeps showing the error, since os.Exit skips this
+	defer restoreButton()
 
-	err := runUpdate(o.Channel, "/", o.Pullers, o.PullRetries)
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	err = runUpdate(ctx, o, "/")
 	if err != nil {
-		button(buttonError)
 		errMsg := err.Error()
+		if ctx.Err() != nil {
+			errMsg = "cancelled: " + errMsg
+		}
 		setStatus("failed", nil, &errMsg)
 		fmt.Fprintln(os.Stderr, err)
+		// os.Exit skips the deferred calls
+		lock.Unlock()
 		os.Exit(1)
 	}
 
 	return nil
 }
 
-func runUpdate(specifiedChannel string, rootDir string, maxPullers, maxPullRetries int) error {
+func runUpdate(ctx context.Context, o *Opts, rootDir string) error {
 	// prepare
-	button(buttonRainbow)
 	setStatus("preparing", nil, nil)
 
-	// get channel
-	channel, channelSource := getChannel(specifiedChannel)
-	logChannelDetection(channel, channelSource)
-
-	// get release data
-	releaseData, err := fetchReleaseData(channel)
+	var channel, configureExtractDir string
+	var releaseData *platconf.ReleaseManifestV2
+	var err error
+	if o.ApplyStaged {
+		releaseData, channel, configureExtractDir, err = prepareStagedRelease(ctx, o, rootDir)
+	} else {
+		releaseData, channel, configureExtractDir, err = prepareRelease(ctx, o, rootDir)
+		if configureExtractDir != "" {
+			defer os.RemoveAll(configureExtractDir)
+		}
+	}
 	if err != nil {
 		return err
 	}
 
-	// get & extract 'configure'
-	configureImgData := releaseData.GetImageByName("quay.io/experimentalplatform/configure")
-	if configureImgData == nil {
-		return fmt.Errorf("configure image data not found in the manifest")
+	if releaseData == nil {
+		setStatus("done", nil, nil)
+		return nil
 	}
 
-	configureExtractDir, err := extractConfigure(configureImgData.Tag)
-	if err != nil {
-		return err
+	if o.DownloadOnly {
+		_, source := getChannel(o.Channel)
+		err = stageRelease(rootDir, channel, source, configureExtractDir, releaseData)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("Build %d is staged, install it with 'platconf update --apply-staged'\n", releaseData.Build)
+		setStatus("staged", nil, nil)
+		return nil
 	}
-	defer os.RemoveAll(configureExtractDir)
+
+	setStatus("installing", nil, nil)
 
 	// setup paths
 	fmt.Println("Creating folders in '/etc/systemd' in case they don't exist yet.")
@@ -89,10 +194,23 @@ func runUpdate(specifiedChannel string, rootDir string, maxPullers, maxPullRetri
 		ioutil.WriteFile(hostameFilePath, []byte("protonet"), 0644)
 	}
 
-	err = performOSUpdate()
-	if err != nil {
-		// we also get an error on a "no update" result, so this is fine
-		log.Println("update-engine returned error:", err.Error())
+	if o.Reapply {
+		log.Println("Skipping the OS update while reapplying the release")
+		showButtonPhase(phaseOSUpdateSkipped)
+	} else if o.Bundle != "" {
+		log.Println("Skipping the OS update while installing from a bundle")
+		showButtonPhase(phaseOSUpdateSkipped)
+	} else {
+		osUpdateCtx, cancel := phaseContext(ctx, o.OSUpdateTimeout)
+		err = performOSUpdate(osUpdateCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return fmt.Errorf("runUpdate: %s", ctx.Err().Error())
+		}
+		if err != nil {
+			// we also get an error on a "no update" result, so this is fine
+			log.Println("update-engine returned error:", err.Error())
+		}
 	}
 
 	err = setupUtilityScripts(rootDir, configureExtractDir)
@@ -105,46 +223,74 @@ func runUpdate(specifiedChannel string, rootDir string, maxPullers, maxPullRetri
 		return err
 	}
 
-	err = pullAllImages(releaseData, maxPullers, maxPullRetries)
+	err = cleanupSystemd(rootDir)
 	if err != nil {
 		return err
 	}
 
-	err = parseAllTemplates(rootDir, configureExtractDir, releaseData)
+	err = setupUdev(rootDir, configureExtractDir)
 	if err != nil {
 		return err
 	}
 
-	err = cleanupSystemd(rootDir)
+	systemdCtx, cancel := phaseContext(ctx, o.SystemdTimeout)
+	defer cancel()
+
+	err = setupSystemD(systemdCtx, rootDir, configureExtractDir)
 	if err != nil {
 		return err
 	}
 
-	err = setupUdev(rootDir, configureExtractDir)
+	// a bundle keeps the channel unless one was requested
+	if channel != "" {
+		err = setupChannelFile(systemdCtx, rootChannelFilePath(rootDir), channel)
+		if err != nil {
+			return err
+		}
+	}
+
+	// past this point the update is finished as a whole
+	if ctx.Err() != nil {
+		return fmt.Errorf("runUpdate: %s", ctx.Err().Error())
+	}
+
+	setStatus("finalizing", nil, nil)
+
+	err = finalize(releaseData, rootDir)
 	if err != nil {
 		return err
 	}
 
-	err = setupSystemD(rootDir, configureExtractDir)
+	err = recordInstalledFiles(rootDir)
 	if err != nil {
 		return err
 	}
 
-	err = setupChannelFile(path.Join(rootDir, "etc/protonet/system/channel"), channel)
+	err = archiveRelease(rootDir, configureExtractDir, releaseData)
 	if err != nil {
 		return err
 	}
 
-	setStatus("finalizing", nil, nil)
-
-	err = finalize(releaseData, rootDir)
+	// a staged release is outdated once another one has been installed
+	err = removeStagedRelease(rootDir)
 	if err != nil {
-		return err
+		log.Printf("WARNING: failed to remove the staged release: %s\n", err.Error())
+	}
+
+	// the new release is checked by 'platconf postboot' after the reboot
+	err = os.Remove(postbootStatePath(rootDir))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("WARNING: failed to reset the postboot state: %s\n", err.Error())
 	}
 
 	setStatus("done", nil, nil)
 
-	// TODO allow to skip the reboot
+	if o.Reapply {
+		log.Println("Release reapplied, skipping the reboot")
+		return nil
+	}
+
+	showButtonPhase(phaseRebootPending)
 	log.Println("Triggering a reboot")
 	rebootCmd := exec.Command("/usr/sbin/shutdown", "--reboot", "1")
 	rebootCmd.Run()
@@ -152,24 +298,128 @@ func runUpdate(specifiedChannel string, rootDir string, maxPullers, maxPullRetri
 	return nil
 }
 
-func tryLockUpdate(path string) *lockfile.Lockfile {
-	lock, err := lockfile.New(lockfilePath)
+// prepareRelease fetches the manifest (or reads it from the bundle),
+// extracts and renders configure and pulls all images. It returns a nil
+// manifest if the release is installed already. The returned configure
+// directory is to be removed by the caller, even on errors.
+func prepareRelease(ctx context.Context, o *Opts, rootDir string) (*platconf.ReleaseManifestV2, string, string, error) {
+	var channel string
+	var releaseData *platconf.ReleaseManifestV2
+	var err error
+	if o.Bundle != "" {
+		if !o.SkipPreflight {
+			// the images take about as much space as the bundle
+			info, err := os.Stat(o.Bundle)
+			if err != nil {
+				return nil, "", "", err
+			}
+
+			err = preflight(ctx, rootDir, nil, info.Size())
+			if err != nil {
+				return nil, "", "", err
+			}
+		}
+
+		// the bundle brings the manifest and the images, no downloads needed
+		loadCtx, cancel := phaseContext(ctx, o.ExtractTimeout)
+		var recordedChannel string
+		releaseData, recordedChannel, err = loadBundle(loadCtx, o.Bundle)
+		cancel()
+		if err != nil {
+			return nil, "", "", err
+		}
+
+		channel, err = bundleChannel(o.Channel, recordedChannel)
+		if err != nil {
+			return nil, "", "", err
+		}
+		if channel != "" {
+			log.Printf("Installing build %d from the bundle, switching to channel '%s'\n", releaseData.Build, channel)
+		} else {
+			log.Printf("Installing build %d from the bundle, keeping the channel\n", releaseData.Build)
+		}
+	} else {
+		// get channel
+		var source channelSource
+		channel, source = getChannel(o.Channel)
+		logChannelDetection(channel, source)
+
+		// get release data
+		manifestCtx, cancel := phaseContext(ctx, o.ManifestTimeout)
+		releaseData, err = fetchReleaseData(manifestCtx, channel)
+		cancel()
+		if err != nil {
+			return nil, "", "", err
+		}
+
+		if !o.SkipPreflight {
+			err = preflight(ctx, rootDir, releaseData, 0)
+			if err != nil {
+				return nil, "", "", err
+			}
+		}
+	}
+
+	// an interrupted update may have left its export container behind
+	err = removeExportContainers()
 	if err != nil {
-		panic(err)
+		log.Printf("WARNING: failed to remove leftover export containers: %s\n", err.Error())
 	}
-	err = lock.TryLock()
+
+	// get & extract 'configure'
+	configureImgData := releaseData.GetImageByName("quay.io/experimentalplatform/configure")
+	if configureImgData == nil {
+		return nil, "", "", fmt.Errorf("configure image data not found in the manifest")
+	}
+
+	extractCtx, cancel := phaseContext(ctx, o.ExtractTimeout)
+	configureExtractDir, err := extractConfigure(extractCtx, configureImgData.Tag, o.Bundle == "")
+	cancel()
 	if err != nil {
-		if err == lockfile.ErrBusy {
-			log.Println("another platconf instance is already running an update")
-			os.Exit(1)
+		return nil, "", "", err
+	}
+
+	// the templates only depend on the manifest, so render them right away
+	// in order to compare them with the installed units
+	err = parseAllTemplates(rootDir, configureExtractDir, releaseData)
+	if err != nil {
+		return nil, "", configureExtractDir, err
+	}
+
+	if !o.Force && !o.Reapply {
+		unchanged, err := isReleaseUnchanged(rootDir, configureExtractDir, releaseData)
+		if err != nil {
+			return nil, "", configureExtractDir, err
 		}
 
-		log.Println("Failed to obtain lock", lockfilePath)
-		log.Println(err)
-		os.Exit(1)
+		if unchanged {
+			log.Printf("Build %d is already installed, nothing to do. Use --force to install it anyway.\n", releaseData.Build)
+			return nil, "", configureExtractDir, nil
+		}
+	}
+
+	if o.Bundle == "" {
+		schedule, err := newDownloadSchedule(o.DownloadRate, o.DownloadWindow)
+		if err != nil {
+			return nil, "", configureExtractDir, err
+		}
+
+		// waiting for the download window may take longer than any pull timeout
+		pullTimeout := o.PullTimeout
+		if o.DownloadWindow != "" {
+			pullTimeout = 0
+		}
+
+		setStatus("downloading", nil, nil)
+		pullCtx, cancel := phaseContext(ctx, pullTimeout)
+		err = pullAllImages(pullCtx, releaseData, o.Pullers, o.PullRetries, schedule)
+		cancel()
+		if err != nil {
+			return nil, "", configureExtractDir, err
+		}
 	}
 
-	return &lock
+	return releaseData, channel, configureExtractDir, nil
 }
 
 func setupPaths(rootPrefix string) error {
@@ -193,13 +443,17 @@ func setupPaths(rootPrefix string) error {
 	return nil
 }
 
-func fetchReleaseData(channel string) (*platconf.ReleaseManifestV2, error) {
-	data, err := fetchReleaseDataV2(channel)
+func fetchReleaseData(ctx context.Context, channel string) (*platconf.ReleaseManifestV2, error) {
+	data, err := fetchReleaseDataV2(ctx, channel)
 	if err != nil {
 		log.Printf("Couldnt fetch manifest v2: %s\n", err.Error())
 		log.Printf("Trying v1\n")
 
-		dataV1, err := fetchReleaseDataV1(channel)
+		if ctx.Err() != nil {
+			return nil, err
+		}
+
+		dataV1, err := fetchReleaseDataV1(ctx, channel)
 		if err != nil {
 			return nil, err
 		}
@@ -210,12 +464,18 @@ func fetchReleaseData(channel string) (*platconf.ReleaseManifestV2, error) {
 	return data, nil
 }
 
-func fetchReleaseJSONv2(channel string) ([]byte, error) {
-	url := fmt.Sprintf("https://raw.githubusercontent.com/protonet/builds/master/manifest-v2/%s.json", channel)
-	resp, err := http.Get(url)
+func fetchReleaseJSONv2(ctx context.Context, channel string) ([]byte, error) {
+	url := fmt.Sprintf(manifestURLv2, channel)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 
 	switch resp.StatusCode {
 	case http.StatusOK:
@@ -234,8 +494,8 @@ func fetchReleaseJSONv2(channel string) ([]byte, error) {
 	return data, nil
 }
 
-func fetchReleaseDataV2(channel string) (*platconf.ReleaseManifestV2, error) {
-	data, err := fetchReleaseJSONv2(channel)
+func fetchReleaseDataV2(ctx context.Context, channel string) (*platconf.ReleaseManifestV2, error) {
+	data, err := fetchReleaseJSONv2(ctx, channel)
 	if err != nil {
 		return nil, err
 	}
@@ -249,13 +509,19 @@ func fetchReleaseDataV2(channel string) (*platconf.ReleaseManifestV2, error) {
 	return &manifest, nil
 }
 
-func fetchReleaseJSONv1(channel string) ([]byte, error) {
-	url := fmt.Sprintf("https://raw.githubusercontent.com/protonet/builds/master/%s.json", channel)
-	resp, err := http.Get(url)
+func fetchReleaseJSONv1(ctx context.Context, channel string) ([]byte, error) {
+	url := fmt.Sprintf(manifestURLv1, channel)
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
 
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
 	switch resp.StatusCode {
 	case http.StatusOK:
 		break
@@ -273,8 +539,8 @@ func fetchReleaseJSONv1(channel string) ([]byte, error) {
 	return data, nil
 }
 
-func fetchReleaseDataV1(channel string) (*platconf.ReleaseManifestV1, error) {
-	data, err := fetchReleaseJSONv1(channel)
+func fetchReleaseDataV1(ctx context.Context, channel string) (*platconf.ReleaseManifestV1, error) {
+	data, err := fetchReleaseJSONv1(ctx, channel)
 	if err != nil {
 		return nil, err
 	}
@@ -292,20 +558,23 @@ func fetchReleaseDataV1(channel string) (*platconf.ReleaseManifestV1, error) {
 	return &manifest[0], nil
 }
 
-func extractConfigure(tag string) (string, error) {
+func extractConfigure(ctx context.Context, tag string, pull bool) (string, error) {
 	tmpDir, err := ioutil.TempDir("", "platconf_")
 	if err != nil {
 		return "", err
 	}
 
-	log.Println("Pulling configure image")
-	err = pullImage("quay.io/experimentalplatform/configure", tag, nil)
-	if err != nil {
-		return "", err
+	if pull {
+		log.Println("Pulling configure image")
+		err = pullImage(ctx, "quay.io/experimentalplatform/configure", tag, nil)
+		if err != nil {
+			os.RemoveAll(tmpDir)
+			return "", err
+		}
 	}
 
 	log.Println("Extracting configure image")
-	err = extractDockerImage("quay.io/experimentalplatform/configure", tag, tmpDir)
+	err = extractDockerImage(ctx, "quay.io/experimentalplatform/configure", tag, tmpDir)
 	if err != nil {
 		os.RemoveAll(tmpDir)
 		return "", err
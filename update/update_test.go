@@ -1,11 +1,15 @@
 package update
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"testing"
+	"time"
 
 	"github.com/experimental-platform/platconf/platconf"
 	"github.com/jarcoal/httpmock"
@@ -50,14 +54,14 @@ func TestFetchReleaseJSON(t *testing.T) {
 	mockURL2 := fmt.Sprintf("https://raw.githubusercontent.com/protonet/builds/master/manifest-v2/%s.json", testChannelNoAccess)
 	httpmock.RegisterResponder("GET", mockURL2, httpmock.NewStringResponder(403, "Access denied."))
 
-	data, err := fetchReleaseJSONv2(testChannel)
+	data, err := fetchReleaseJSONv2(context.Background(), testChannel)
 	assert.Nil(t, err)
 	assert.Equal(t, len(testBody), len(data))
 
-	_, err = fetchReleaseJSONv2(testChannelNoAccess)
+	_, err = fetchReleaseJSONv2(context.Background(), testChannelNoAccess)
 	assert.NotNil(t, err)
 
-	_, err = fetchReleaseJSONv2("noSuchChannel")
+	_, err = fetchReleaseJSONv2(context.Background(), "noSuchChannel")
 	assert.NotNil(t, err)
 }
 
@@ -111,11 +115,32 @@ func TestFetchReleaseData(t *testing.T) {
 	mockURL2 := fmt.Sprintf("https://raw.githubusercontent.com/protonet/builds/master/manifest-v2/%s.json", testChannelBrokenJSON)
 	httpmock.RegisterResponder("GET", mockURL2, httpmock.NewStringResponder(200, testBrokenJSON))
 
-	manifest, err := fetchReleaseDataV2(testChannel)
+	manifest, err := fetchReleaseDataV2(context.Background(), testChannel)
 	assert.Nil(t, err)
 	assert.NotNil(t, manifest)
 	assert.EqualValues(t, expectedJSON, *manifest)
 
-	_, err = fetchReleaseDataV2(testChannelBrokenJSON)
+	_, err = fetchReleaseDataV2(context.Background(), testChannelBrokenJSON)
 	assert.NotNil(t, err)
 }
+
+func TestFetchReleaseDataTimeout(t *testing.T) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer srv.Close()
+	defer close(done)
+
+	defer func(v2, v1 string) { manifestURLv2, manifestURLv1 = v2, v1 }(manifestURLv2, manifestURLv1)
+	manifestURLv2 = srv.URL + "/manifest-v2/%s.json"
+	manifestURLv1 = srv.URL + "/%s.json"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := fetchReleaseData(ctx, "stable")
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
@@ -0,0 +1,354 @@
+package update
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/experimental-platform/platconf/platconf"
+)
+
+// installedFilesPath is where the list of files installed by the update is
+// stored, relative to the root directory
+const installedFilesPath = "etc/protonet/system/installed-files.json"
+
+// managedFiles are single files installed by the update
+var managedFiles = []string{
+	"/etc/udev/rules.d/80-protonet.rules",
+	"/etc/systemd/system/docker.service.d/50-log-warn.conf",
+	"/etc/systemd/journald.conf.d/journald_protonet.conf",
+	"/etc/sysctl.d/sysctl-klog.conf",
+}
+
+// exit codes of 'verify'
+const (
+	verifyClean = 0
+	verifyError = 1
+	verifyDrift = 2
+)
+
+// installedFile describes a file as installed by the update
+type installedFile struct {
+	Path   string      `json:"path"`
+	Mode   os.FileMode `json:"mode"`
+	SHA256 string      `json:"sha256,omitempty"`
+	Link   string      `json:"link,omitempty"`
+}
+
+// driftReport lists the differences between the recorded and the live files
+type driftReport struct {
+	Modified   []string
+	Missing    []string
+	Unexpected []string
+}
+
+func (dr *driftReport) isClean() bool {
+	return len(dr.Modified) == 0 && len(dr.Missing) == 0 && len(dr.Unexpected) == 0
+}
+
+// VerifyOpts contains command line parameters for the 'verify' command
+type VerifyOpts struct {
+	Repair bool `long:"repair" description:"Reinstall the files from the archived release"`
+
+	SystemdTimeout time.Duration `long:"systemd-timeout" description:"Timeout for setting up the systemd units while repairing, 0 disables it" default:"5m"`
+
+	Config *platconf.Config `no-flag:"true"`
+}
+
+func isUnmanagedBinary(name string) bool {
+	for _, b := range unmanagedBinaries {
+		if name == b {
+			return true
+		}
+	}
+
+	return false
+}
+
+// listManagedFiles returns the paths (relative to rootDir) of the files
+// which are installed by the update. With includeForeign it also returns
+// the files in the same directories which weren't installed by the update,
+// e.g. hand-written units.
+func listManagedFiles(rootDir string, includeForeign bool) ([]string, error) {
+	result := []string{}
+
+	// directories owned completely by the update
+	for _, dir := range []string{"/opt/bin", "/etc/systemd/system/scripts"} {
+		entries, err := ioutil.ReadDir(path.Join(rootDir, dir))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		for _, e := range entries {
+			if e.IsDir() || (dir == "/opt/bin" && isUnmanagedBinary(e.Name())) {
+				continue
+			}
+			result = append(result, path.Join(dir, e.Name()))
+		}
+	}
+
+	// directories shared with the system or the user
+	for _, dir := range []string{"/etc/systemd/system", "/etc/systemd/network"} {
+		entries, err := ioutil.ReadDir(path.Join(rootDir, dir))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		for _, e := range entries {
+			if !e.Mode().IsRegular() {
+				continue
+			}
+
+			fullPath := path.Join(rootDir, dir, e.Name())
+			isPlatform, err := isPlatformUnit(fullPath)
+			if err != nil {
+				return nil, err
+			}
+
+			if isPlatform || includeForeign {
+				result = append(result, path.Join(dir, e.Name()))
+			}
+		}
+	}
+
+	for _, f := range managedFiles {
+		_, err := os.Lstat(path.Join(rootDir, f))
+		if err == nil {
+			result = append(result, f)
+		}
+	}
+
+	sort.Strings(result)
+	return result, nil
+}
+
+// describeFile returns the mode, the hash or the link target of a file
+func describeFile(rootDir, filePath string) (*installedFile, error) {
+	fullPath := path.Join(rootDir, filePath)
+	info, err := os.Lstat(fullPath)
+	if err != nil {
+		return nil, err
+	}
+
+	result := installedFile{
+		Path: filePath,
+		Mode: info.Mode(),
+	}
+
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		result.Link, err = os.Readlink(fullPath)
+		if err != nil {
+			return nil, err
+		}
+	case info.Mode().IsRegular():
+		f, err := os.Open(fullPath)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		hash := sha256.New()
+		_, err = io.Copy(hash, f)
+		if err != nil {
+			return nil, err
+		}
+		result.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	}
+
+	return &result, nil
+}
+
+// recordInstalledFiles stores the list of installed files with their hashes
+func recordInstalledFiles(rootDir string) error {
+	log.Println("Recording the installed files")
+	files, err := listManagedFiles(rootDir, false)
+	if err != nil {
+		return err
+	}
+
+	record := []installedFile{}
+	for _, f := range files {
+		desc, err := describeFile(rootDir, f)
+		if err != nil {
+			return err
+		}
+		record = append(record, *desc)
+	}
+
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path.Join(rootDir, installedFilesPath), data, 0644)
+}
+
+func readInstalledFiles(rootDir string) ([]installedFile, error) {
+	data, err := ioutil.ReadFile(path.Join(rootDir, installedFilesPath))
+	if err != nil {
+		return nil, err
+	}
+
+	var record []installedFile
+	err = json.Unmarshal(data, &record)
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// verifyInstalledFiles compares the live filesystem with the recorded files
+func verifyInstalledFiles(rootDir string) (*driftReport, error) {
+	record, err := readInstalledFiles(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	liveFiles, err := listManagedFiles(rootDir, true)
+	if err != nil {
+		return nil, err
+	}
+
+	report := driftReport{
+		Modified:   []string{},
+		Missing:    []string{},
+		Unexpected: []string{},
+	}
+
+	recorded := make(map[string]bool)
+	for _, expected := range record {
+		recorded[expected.Path] = true
+
+		actual, err := describeFile(rootDir, expected.Path)
+		if os.IsNotExist(err) {
+			report.Missing = append(report.Missing, expected.Path)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if *actual != expected {
+			report.Modified = append(report.Modified, expected.Path)
+		}
+	}
+
+	for _, f := range liveFiles {
+		if !recorded[f] {
+			report.Unexpected = append(report.Unexpected, f)
+		}
+	}
+
+	return &report, nil
+}
+
+// reinstallRelease installs the files of an already downloaded and rendered
+// release without touching the images
+func reinstallRelease(ctx context.Context, rootDir, configureDir string, systemdTimeout time.Duration) error {
+	steps := []func(string, string) error{
+		setupUtilityScripts,
+		setupBinaries,
+		func(rootDir, _ string) error { return cleanupSystemd(rootDir) },
+		setupUdev,
+		func(rootDir, configureDir string) error {
+			systemdCtx, cancel := phaseContext(ctx, systemdTimeout)
+			defer cancel()
+			return setupSystemD(systemdCtx, rootDir, configureDir)
+		},
+	}
+
+	err := setupPaths(rootDir)
+	if err != nil {
+		return err
+	}
+
+	for _, step := range steps {
+		err = step(rootDir, configureDir)
+		if err != nil {
+			return err
+		}
+
+		if ctx.Err() != nil {
+			return fmt.Errorf("reinstallRelease: %s", ctx.Err().Error())
+		}
+	}
+
+	return recordInstalledFiles(rootDir)
+}
+
+// repairRelease reinstalls the installed release from the archive
+func repairRelease(ctx context.Context, rootDir string, systemdTimeout time.Duration) error {
+	build, err := readInstalledBuild(rootDir)
+	if err != nil {
+		return fmt.Errorf("reading the installed release number: %s", err.Error())
+	}
+
+	release, _, err := getArchivedRelease(rootDir, build)
+	if err != nil {
+		return fmt.Errorf("%s, use 'platconf update --reapply' instead", err.Error())
+	}
+
+	log.Printf("Reinstalling build %d from '%s'\n", build, release.Dir)
+	return reinstallRelease(ctx, rootDir, release.ConfigureDir, systemdTimeout)
+}
+
+// Execute is the function ran when the 'verify' command is used
+func (o *VerifyOpts) Execute(args []string) error {
+	applyConfig(o.Config)
+
+	report, err := verifyInstalledFiles("/")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to verify the installed files: %s\n", err.Error())
+		os.Exit(verifyError)
+	}
+
+	for _, f := range report.Modified {
+		fmt.Printf("MODIFIED   %s\n", f)
+	}
+	for _, f := range report.Missing {
+		fmt.Printf("MISSING    %s\n", f)
+	}
+	for _, f := range report.Unexpected {
+		fmt.Printf("UNEXPECTED %s\n", f)
+	}
+
+	if report.isClean() {
+		fmt.Println("All installed files are unchanged.")
+		return nil
+	}
+
+	if !o.Repair {
+		os.Exit(verifyDrift)
+	}
+
+	platconf.RequireRoot()
+	lock := tryLockUpdate(lockfilePath)
+	ctx, cancel := signalContext()
+	err = repairRelease(ctx, "/", o.SystemdTimeout)
+	cancel()
+	lock.Unlock()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Repair failed: %s\n", err.Error())
+		os.Exit(verifyError)
+	}
+
+	fmt.Println("Repair completed. Unexpected files, if any, have been left in place.")
+	return nil
+}
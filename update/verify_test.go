@@ -0,0 +1,66 @@
+package update
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyInstalledFiles(t *testing.T) {
+	tempRootDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempRootDir)
+
+	err = setupPaths(tempRootDir)
+	assert.Nil(t, err)
+	err = os.MkdirAll(path.Join(tempRootDir, "etc/protonet/system"), 0755)
+	assert.Nil(t, err)
+
+	systemDir := path.Join(tempRootDir, "etc/systemd/system")
+	scriptsDir := path.Join(systemDir, "scripts")
+	binDir := path.Join(tempRootDir, "opt/bin")
+
+	// an installed release
+	assert.Nil(t, ioutil.WriteFile(path.Join(systemDir, "foo.service"), []byte("# ExperimentalPlatform\nfoo"), 0644))
+	assert.Nil(t, ioutil.WriteFile(path.Join(systemDir, "bar.service"), []byte("# ExperimentalPlatform\nbar"), 0644))
+	assert.Nil(t, ioutil.WriteFile(path.Join(scriptsDir, "script.sh"), []byte("#!/bin/sh"), 0755))
+	assert.Nil(t, os.Symlink(path.Join(scriptsDir, "script.sh"), path.Join(binDir, "script")))
+	assert.Nil(t, ioutil.WriteFile(path.Join(tempRootDir, "etc/udev/rules.d/80-protonet.rules"), []byte("rules"), 0644))
+	// not managed by the update
+	assert.Nil(t, ioutil.WriteFile(path.Join(binDir, "platconf"), []byte("binary"), 0755))
+
+	err = recordInstalledFiles(tempRootDir)
+	assert.Nil(t, err)
+
+	report, err := verifyInstalledFiles(tempRootDir)
+	assert.Nil(t, err)
+	assert.True(t, report.isClean())
+
+	// now let's break things
+	assert.Nil(t, ioutil.WriteFile(path.Join(systemDir, "foo.service"), []byte("# ExperimentalPlatform\nhand-edited"), 0644))
+	assert.Nil(t, os.Chmod(path.Join(scriptsDir, "script.sh"), 0644))
+	assert.Nil(t, os.Remove(path.Join(systemDir, "bar.service")))
+	assert.Nil(t, os.Remove(path.Join(binDir, "script")))
+	assert.Nil(t, os.Symlink("/bin/false", path.Join(binDir, "script")))
+	assert.Nil(t, ioutil.WriteFile(path.Join(systemDir, "custom.service"), []byte("[Unit]\n"), 0644))
+	assert.Nil(t, ioutil.WriteFile(path.Join(binDir, "platconf"), []byte("new binary"), 0755))
+
+	report, err = verifyInstalledFiles(tempRootDir)
+	assert.Nil(t, err)
+	assert.False(t, report.isClean())
+	assert.Equal(t, []string{"/etc/systemd/system/foo.service", "/etc/systemd/system/scripts/script.sh", "/opt/bin/script"}, report.Modified)
+	assert.Equal(t, []string{"/etc/systemd/system/bar.service"}, report.Missing)
+	assert.Equal(t, []string{"/etc/systemd/system/custom.service"}, report.Unexpected)
+}
+
+func TestVerifyInstalledFilesNoRecord(t *testing.T) {
+	tempRootDir, err := ioutil.TempDir("", "platconf-unittest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempRootDir)
+
+	_, err = verifyInstalledFiles(tempRootDir)
+	assert.NotNil(t, err)
+}
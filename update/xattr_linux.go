@@ -0,0 +1,11 @@
+//go:build linux
+// +build linux
+
+package update
+
+import "syscall"
+
+// setXattr sets an extended attribute of a file
+func setXattr(path, name, value string) error {
+	return syscall.Setxattr(path, name, []byte(value), 0)
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package update
+
+import "log"
+
+// setXattr is a no-op outside of Linux
+func setXattr(path, name, value string) error {
+	log.Printf("setXattr: ignoring attribute '%s' of '%s'\n", name, path)
+	return nil
+}
@@ -1,20 +1,136 @@
 package main
 
-import "fmt"
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
 
+	"github.com/experimental-platform/platconf/platconf"
+)
+
+// build metadata, set at link time
 var (
 	VersionTag string
+	GitCommit  string
+	BuildDate  string
+)
+
+// exit codes of 'version --check'
+const (
+	versionUpToDate        = 0
+	versionCheckError      = 1
+	versionUpdateAvailable = 2
 )
 
 type versionOpts struct {
+	JSON       bool `long:"json" description:"Print the version information as JSON"`
+	Check      bool `long:"check" description:"Check whether a newer release is available"`
+	Prerelease bool `long:"prerelease" description:"Consider prereleases when checking for a newer release"`
+}
+
+// versionInfo describes the running binary
+type versionInfo struct {
+	Version         string `json:"version"`
+	Development     bool   `json:"development"`
+	GitCommit       string `json:"git_commit"`
+	BuildDate       string `json:"build_date"`
+	GoVersion       string `json:"go_version"`
+	Platform        string `json:"platform"`
+	ManifestSchemas []int  `json:"manifest_schemas"`
+}
+
+func getVersionInfo() *versionInfo {
+	return &versionInfo{
+		Version:         VersionTag,
+		Development:     VersionTag == "",
+		GitCommit:       GitCommit,
+		BuildDate:       BuildDate,
+		GoVersion:       runtime.Version(),
+		Platform:        fmt.Sprintf("%s/%s", runtime.GOOS, runtime.GOARCH),
+		ManifestSchemas: platconf.SupportedManifestVersions,
+	}
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+func printVersionInfo(w io.Writer, info *versionInfo) {
+	// selfupdate looks for this line to test new binaries, keep it intact
+	if info.Development {
+		fmt.Fprintln(w, "No version information available. This is a development binary.")
+	} else {
+		fmt.Fprintf(w, "Platform Configurator release %s\n", info.Version)
+	}
+
+	schemas := []string{}
+	for _, v := range info.ManifestSchemas {
+		schemas = append(schemas, fmt.Sprintf("v%d", v))
+	}
+
+	fmt.Fprintf(w, "Git commit:       %s\n", orUnknown(info.GitCommit))
+	fmt.Fprintf(w, "Build date:       %s\n", orUnknown(info.BuildDate))
+	fmt.Fprintf(w, "Go version:       %s %s\n", info.GoVersion, info.Platform)
+	fmt.Fprintf(w, "Manifest schemas: %s\n", strings.Join(schemas, ", "))
 }
 
 func (o *versionOpts) Execute(args []string) error {
-	if VersionTag == "" {
-		fmt.Println("No version information available. This is a development binary.")
+	info := getVersionInfo()
+	if o.JSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err := encoder.Encode(info)
+		if err != nil {
+			return err
+		}
 	} else {
-		fmt.Printf("Platform Configurator release %s\n", VersionTag)
+		printVersionInfo(os.Stdout, info)
+	}
+
+	if o.Check {
+		os.Exit(checkPlatconfVersion(o.Prerelease))
 	}
 
 	return nil
 }
+
+// checkPlatconfVersion reports whether a newer release than the running
+// one is available and returns the exit code
+func checkPlatconfVersion(prerelease bool) int {
+	releases, err := fetchReleases(opts.Config.SelfupdateSource)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return versionCheckError
+	}
+
+	latestRelease, err := selectRelease(releases, "", prerelease)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return versionCheckError
+	}
+
+	if VersionTag == "" {
+		fmt.Printf("Latest release is %s, can't compare it with a development binary.\n", latestRelease.TagName)
+		return versionCheckError
+	}
+
+	cmp, err := compareTags(latestRelease.TagName, VersionTag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Can't compare release %s with the running version: %s\n", latestRelease.TagName, err.Error())
+		return versionCheckError
+	}
+
+	if cmp > 0 {
+		fmt.Printf("Release %s is available, run 'platconf selfupdate' to install it.\n", latestRelease.TagName)
+		return versionUpdateAvailable
+	}
+
+	fmt.Printf("Up-to-date, latest release is %s.\n", latestRelease.TagName)
+	return versionUpToDate
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"runtime"
+	"testing"
+
+	"github.com/experimental-platform/platconf/platconf"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetVersionInfo(t *testing.T) {
+	defer func(tag, commit, date string) {
+		VersionTag, GitCommit, BuildDate = tag, commit, date
+	}(VersionTag, GitCommit, BuildDate)
+
+	VersionTag, GitCommit, BuildDate = "", "", ""
+	info := getVersionInfo()
+	assert.True(t, info.Development)
+	assert.Equal(t, runtime.Version(), info.GoVersion)
+	assert.Equal(t, runtime.GOOS+"/"+runtime.GOARCH, info.Platform)
+	assert.Equal(t, platconf.SupportedManifestVersions, info.ManifestSchemas)
+
+	VersionTag, GitCommit, BuildDate = "v1.2.3", "abc123", "2017-05-01T10:00:00Z"
+	info = getVersionInfo()
+	assert.False(t, info.Development)
+
+	data, err := json.Marshal(info)
+	assert.Nil(t, err)
+	var fields map[string]interface{}
+	assert.Nil(t, json.Unmarshal(data, &fields))
+	assert.Equal(t, "v1.2.3", fields["version"])
+	assert.Equal(t, false, fields["development"])
+	assert.Equal(t, "abc123", fields["git_commit"])
+	assert.Equal(t, "2017-05-01T10:00:00Z", fields["build_date"])
+	assert.Equal(t, runtime.Version(), fields["go_version"])
+	assert.Equal(t, runtime.GOOS+"/"+runtime.GOARCH, fields["platform"])
+	assert.Len(t, fields["manifest_schemas"], len(platconf.SupportedManifestVersions))
+}
+
+func TestPrintVersionInfo(t *testing.T) {
+	info := &versionInfo{
+		Version:         "v1.2.3",
+		GitCommit:       "abc123",
+		GoVersion:       "go1.7.5",
+		Platform:        "linux/amd64",
+		ManifestSchemas: platconf.SupportedManifestVersions,
+	}
+
+	var out bytes.Buffer
+	printVersionInfo(&out, info)
+	assert.Contains(t, out.String(), "Platform Configurator release v1.2.3\n")
+	assert.Contains(t, out.String(), "Git commit:       abc123\n")
+	assert.Contains(t, out.String(), "Build date:       unknown\n")
+	assert.Contains(t, out.String(), "Go version:       go1.7.5 linux/amd64\n")
+	assert.Contains(t, out.String(), "Manifest schemas: v1, v2\n")
+
+	// selfupdate relies on this line for development binaries
+	out.Reset()
+	printVersionInfo(&out, &versionInfo{Development: true})
+	assert.Contains(t, out.String(), "No version information available. This is a development binary.\n")
+}